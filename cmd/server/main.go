@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -17,7 +18,21 @@ const defaultPort = 8080
 const defaultWorkersCount = 2
 const defaultTimeout = 90
 const defaultMemoryLimit = 250
+const defaultResultCacheTTL = 0
 const defaultLogLvl = "info"
+const defaultMaxFrames = 300
+const defaultMaxTotalPixels = 400_000_000
+const defaultMaxPages = 500
+const defaultMaxSVGElements = 10000
+const defaultFontDir = "/usr/share/fonts/truetype/dejavu"
+const defaultOutputProfile = "/usr/share/color/icc/colord/sRGB.icc"
+const defaultWatermarkCacheSizeMB = 256
+const defaultRetryAttempts = 3
+const defaultRetryBaseDelayMs = 200
+const defaultRetryMaxDelayMs = 5000
+const defaultRetryJitter = 1.0
+const defaultWatermarkMaxSizeMB = 10
+const defaultWatermarkFetchTimeout = 10
 
 func main() {
 	flag.Parse()
@@ -34,6 +49,13 @@ func main() {
 		timeout      int
 		memoryLimit  int
 		workersCount int
+		config       internal.ResizerConfig
+		wmConfig     internal.WatermarkConfig
+		wmHosts      string
+		wmTimeout    int
+		resultTTL    int
+		retryBaseMs  int
+		retryMaxMs   int
 	)
 
 	cmd := flag.NewFlagSet(runCmd, flag.ExitOnError)
@@ -42,6 +64,23 @@ func main() {
 	cmd.IntVar(&port, "port", defaultPort, "set HTTP server port")
 	cmd.IntVar(&workersCount, "workers", defaultWorkersCount, "set workers (max count concurrent resizes)")
 	cmd.IntVar(&timeout, "timeout", defaultTimeout, "set HTTP server timeout seconds")
+	cmd.IntVar(&resultTTL, "result-cache-ttl", defaultResultCacheTTL, "set seconds successful resize responses are replayed to identical or same Idempotency-Key requests, 0 disables")
+	cmd.IntVar(&config.MaxFrames, "max-frames", defaultMaxFrames, "set max frames count of animated original")
+	cmd.Int64Var(&config.MaxTotalPixels, "max-total-pixels", defaultMaxTotalPixels, "set max pixels count in all frames of animated original")
+	cmd.IntVar(&config.MaxPages, "max-pages", defaultMaxPages, "set max pages count of document original")
+	cmd.IntVar(&config.MaxSVGElements, "max-svg-elements", defaultMaxSVGElements, "set max elements count of svg original")
+	cmd.StringVar(&config.FontDir, "font-dir", defaultFontDir, "set directory with fonts for text watermarks")
+	cmd.StringVar(&config.OutputProfile, "output-profile", defaultOutputProfile, "set ICC profile colors are converted into when requested")
+	cmd.IntVar(&config.Retry.Attempts, "storage-retry-attempts", defaultRetryAttempts, "set attempts of storage reads, writes and deletes, 1 disables retries")
+	cmd.IntVar(&retryBaseMs, "storage-retry-base-delay", defaultRetryBaseDelayMs, "set milliseconds before the first storage retry, doubled with every next one")
+	cmd.IntVar(&retryMaxMs, "storage-retry-max-delay", defaultRetryMaxDelayMs, "set max milliseconds between storage retries")
+	cmd.Float64Var(&config.Retry.Jitter, "storage-retry-jitter", defaultRetryJitter, "set randomized share 0..1 of storage retry delays")
+	cmd.StringVar(&wmConfig.CacheDir, "watermark-cache-dir", internal.DefaultWatermarkCacheDir, "set directory of persistent watermark cache")
+	cmd.IntVar(&wmConfig.CacheSizeMB, "watermark-cache-size", defaultWatermarkCacheSizeMB, "set MB size limit of watermark cache")
+	cmd.IntVar(&wmConfig.MaxSizeMB, "watermark-max-size", defaultWatermarkMaxSizeMB, "set MB size limit of a single watermark")
+	cmd.StringVar(&wmHosts, "watermark-allowed-hosts", "", "set comma separated hosts and s3 buckets watermarks are fetched from, '*.example.com' allows subdomains, empty allows any")
+	cmd.BoolVar(&wmConfig.AllowPrivateNetworks, "watermark-allow-private", false, "allow fetching watermarks from loopback, private and link-local addresses")
+	cmd.IntVar(&wmTimeout, "watermark-fetch-timeout", defaultWatermarkFetchTimeout, "set watermark fetch timeout seconds")
 
 	if err := cmd.Parse(args); err != nil {
 		fmt.Printf("resizer: error parsing arguments: '%v'\n", err)
@@ -59,12 +98,31 @@ func main() {
 	var server *internal.Server
 	switch cmdName {
 	case runCmd:
-		server = internal.NewHttpServer(
+		config.MemoryMB = memoryLimit
+		config.Retry.BaseDelay = time.Duration(retryBaseMs) * time.Millisecond
+		config.Retry.MaxDelay = time.Duration(retryMaxMs) * time.Millisecond
+		if err := config.Retry.Validate(); err != nil {
+			fmt.Printf("resizer: invalid storage retry flags: '%v'\n", err)
+			os.Exit(1)
+		}
+		wmConfig.FetchTimeout = time.Duration(wmTimeout) * time.Second
+		for _, host := range strings.Split(wmHosts, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				wmConfig.AllowedHosts = append(wmConfig.AllowedHosts, host)
+			}
+		}
+		var err error
+		server, err = internal.NewHttpServer(
 			port,
 			time.Duration(timeout)*time.Second,
-			memoryLimit,
 			workersCount,
+			time.Duration(resultTTL)*time.Second,
+			config,
+			wmConfig,
 			stdLog)
+		if err != nil {
+			stdLog.Fatal("resizer: error creating server: %v", err)
+		}
 	default:
 		stdLog.Fatal("Unknown sub-command: %s\n", args[0])
 	}
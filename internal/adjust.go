@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/nocturnecity/image-resizer/pkg"
+)
+
+const DefaultSharpenSigma = 1.0
+const DefaultSharpenAmount = 1.0
+const DefaultSharpenThreshold = 0.05
+const DefaultBlurSigma = 2.0
+const DefaultBrightness = 0.0
+const DefaultContrast = 0.0
+const DefaultSaturation = 100.0
+const DefaultGamma = 1.0
+const DefaultSepiaTone = 80.0
+const DefaultTint = 50.0
+
+func (rh *ResizeHandler) adjustCommand(filename, result string, animated bool, adjustments []pkg.Adjustment) error {
+	start := time.Now()
+	args := []string{
+		"-limit",
+		"memory",
+		rh.memoryLimit,
+		"-limit",
+		"time",
+		rh.timeout,
+		filename,
+	}
+	if animated {
+		args = append(args, "-coalesce")
+	}
+	for _, adjustment := range adjustments {
+		args = append(args, adjustmentArgs(adjustment)...)
+	}
+	if animated {
+		args = append(args, "-layers", "Optimize")
+	}
+	args = append(args, result)
+
+	cmd := exec.Command("magick", args...)
+	res, err := cmd.CombinedOutput()
+	durationMs := float64(time.Since(start).Milliseconds())
+	rh.log.Debug("%s: duration: %.2f", cmd.String(), durationMs)
+	if string(res) != "" {
+		rh.log.Debug(string(res))
+	}
+	if err != nil {
+		return fmt.Errorf("error adjust file %w, command output: %s", err, res)
+	}
+
+	return nil
+}
+
+// adjustmentArgs translates a validated adjustment into ImageMagick arguments
+func adjustmentArgs(a pkg.Adjustment) []string {
+	switch a.Type {
+	case pkg.AdjustmentSharpen:
+		sigma := orDefault(a.Sigma, DefaultSharpenSigma)
+		amount := orDefault(a.Amount, DefaultSharpenAmount)
+		threshold := orDefault(a.Threshold, DefaultSharpenThreshold)
+		return []string{"-unsharp", fmt.Sprintf("%sx%s+%s+%s", formatFloat(a.Radius), formatFloat(sigma), formatFloat(amount), formatFloat(threshold))}
+	case pkg.AdjustmentBlur:
+		sigma := orDefault(a.Sigma, DefaultBlurSigma)
+		return []string{"-gaussian-blur", fmt.Sprintf("%sx%s", formatFloat(a.Radius), formatFloat(sigma))}
+	case pkg.AdjustmentBrightness:
+		return []string{"-brightness-contrast", fmt.Sprintf("%sx0", formatFloat(valueOrDefault(a.Value, DefaultBrightness)))}
+	case pkg.AdjustmentContrast:
+		return []string{"-brightness-contrast", fmt.Sprintf("0x%s", formatFloat(valueOrDefault(a.Value, DefaultContrast)))}
+	case pkg.AdjustmentSaturation:
+		return []string{"-modulate", fmt.Sprintf("100,%s,100", formatFloat(valueOrDefault(a.Value, DefaultSaturation)))}
+	case pkg.AdjustmentGamma:
+		return []string{"-gamma", formatFloat(valueOrDefault(a.Value, DefaultGamma))}
+	case pkg.AdjustmentGrayscale:
+		// back to sRGB so later steps (watermarks, encoders) see a regular RGB image
+		return []string{"-colorspace", "Gray", "-colorspace", "sRGB"}
+	case pkg.AdjustmentSepia:
+		return []string{"-sepia-tone", fmt.Sprintf("%s%%", formatFloat(valueOrDefault(a.Value, DefaultSepiaTone)))}
+	case pkg.AdjustmentTint:
+		return []string{"-fill", a.Color, "-tint", formatFloat(valueOrDefault(a.Value, DefaultTint))}
+	}
+
+	return nil
+}
+
+func orDefault(value, def float64) float64 {
+	if value == 0 {
+		return def
+	}
+
+	return value
+}
+
+// valueOrDefault keeps explicit zeros, a zero sepia or saturation is meaningful
+func valueOrDefault(value *float64, def float64) float64 {
+	if value == nil {
+		return def
+	}
+
+	return *value
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
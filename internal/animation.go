@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/nocturnecity/image-resizer/pkg"
+)
+
+const DefaultMaxFrames = 300
+const DefaultMaxTotalPixels = 400_000_000
+
+// formats which may carry more than one frame, both as input and output
+var animatedFormats = map[string]bool{
+	"gif":  true,
+	"webp": true,
+}
+
+type animationInfo struct {
+	frames      int
+	durationMs  int
+	totalPixels int64
+}
+
+func (rh *ResizeHandler) getAnimationInfo(filename string) (*animationInfo, error) {
+	cmd := exec.Command(
+		"identify",
+		"-limit",
+		"memory",
+		rh.memoryLimit,
+		"-quiet",
+		// headers only, the limits are checked before any frame is decoded
+		"-ping",
+		"-format",
+		"%W %H %T\n",
+		filename)
+	rh.log.Debug(cmd.String())
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Split(bufio.ScanLines)
+
+	info := &animationInfo{}
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		width, _ := strconv.ParseInt(fields[0], 10, 64)
+		height, _ := strconv.ParseInt(fields[1], 10, 64)
+		// delay is measured in ticks of 1/100 second
+		delay, _ := strconv.Atoi(fields[2])
+		info.frames++
+		info.totalPixels += width * height
+		info.durationMs += delay * 10
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+func (rh *ResizeHandler) checkAnimationLimits(info *animationInfo) error {
+	if info.frames > rh.maxFrames {
+		return fmt.Errorf("%w: %d frames exceed limit of %d", ErrInvalidInput, info.frames, rh.maxFrames)
+	}
+	if info.totalPixels > rh.maxTotalPixels {
+		return fmt.Errorf("%w: %d pixels in all frames exceed limit of %d", ErrInvalidInput, info.totalPixels, rh.maxTotalPixels)
+	}
+
+	return nil
+}
+
+// checkAnimationTransform rejects trim when frames are kept, trimming
+// coalesced frames one by one would give them different sizes
+func (rh *ResizeHandler) checkAnimationTransform() error {
+	if rh.Request.Transform != nil && rh.Request.Transform.Trim && rh.anySizePreservesAnimation() {
+		return fmt.Errorf("%w: trim is not supported for animated originals with preserved animation", ErrInvalidInput)
+	}
+
+	return nil
+}
+
+func (rh *ResizeHandler) isAnimated() bool {
+	return rh.frames > 1
+}
+
+func (rh *ResizeHandler) preservesAnimation(size pkg.Size, format string) bool {
+	return rh.isAnimated() && size.Animation == pkg.AnimationPreserve && animatedFormats[format]
+}
+
+func (rh *ResizeHandler) anySizePreservesAnimation() bool {
+	for _, size := range rh.Request.Sizes {
+		if size.Animation == pkg.AnimationPreserve {
+			return true
+		}
+	}
+
+	return false
+}
+
+// posterFrame selects the first frame of a multi-frame file
+func posterFrame(filename string) string {
+	return fmt.Sprintf("%s[0]", filename)
+}
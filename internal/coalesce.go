@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/nocturnecity/image-resizer/pkg"
+)
+
+// IdempotencyKeyHeader names a request for the result cache instead of its fingerprint
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotentReplayedHeader marks responses served from the result cache
+const IdempotentReplayedHeader = "Idempotent-Replayed"
+
+// MaxIdempotencyKeyLength bounds keys kept in memory
+const MaxIdempotencyKeyLength = 255
+
+// fingerprint identifies requests producing the same outputs
+func fingerprint(req pkg.Request) (string, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(body)
+
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// resultCache keeps successful responses for a short time, so retries of a
+// finished request don't process it again
+type resultCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]resultCacheEntry
+}
+
+type resultCacheEntry struct {
+	fingerprint string
+	response    *pkg.Response
+	expires     time.Time
+}
+
+func newResultCache(ttl time.Duration) *resultCache {
+	return &resultCache{
+		ttl:     ttl,
+		entries: map[string]resultCacheEntry{},
+	}
+}
+
+// Get returns the response stored under the key and the fingerprint of its request
+func (c *resultCache) Get(key string) (*pkg.Response, string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, "", false
+	}
+
+	return entry.response, entry.fingerprint, true
+}
+
+// Set stores the response and drops expired ones
+func (c *resultCache) Set(key, fingerprint string, response *pkg.Response) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = resultCacheEntry{
+		fingerprint: fingerprint,
+		response:    response,
+		expires:     now.Add(c.ttl),
+	}
+}
@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const DefaultOutputProfile = "/usr/share/color/icc/colord/sRGB.icc"
+
+// colorConversionArgs converts the original into the output profile, images
+// without a profile are taken as sRGB, CMYK and gray ones get a plain
+// colorspace transform first as there is no source profile to convert from
+func (rh *ResizeHandler) colorConversionArgs(filename string, hasColorProfile bool) ([]string, error) {
+	if hasColorProfile {
+		// the embedded profile is the source of the conversion
+		return []string{"-profile", rh.outputProfile}, nil
+	}
+
+	colorspace, err := rh.getColorspace(filename)
+	if err != nil {
+		return nil, err
+	}
+	var args []string
+	if colorspace != "sRGB" && colorspace != "RGB" {
+		args = append(args, "-colorspace", "sRGB")
+	}
+	if rh.outputProfile == DefaultOutputProfile {
+		return args, nil
+	}
+
+	// assigning a profile to an untagged image doesn't convert it, so tag it
+	// as sRGB first and convert from there
+	return append(args, "-profile", DefaultOutputProfile, "-profile", rh.outputProfile), nil
+}
+
+func (rh *ResizeHandler) getColorspace(filename string) (string, error) {
+	start := time.Now()
+	cmd := exec.Command(
+		"identify",
+		"-limit",
+		"memory",
+		rh.memoryLimit,
+		"-limit",
+		"time",
+		rh.timeout,
+		"-quiet",
+		"-format",
+		"%[colorspace]",
+		posterFrame(filename))
+	res, err := cmd.Output()
+	durationMs := float64(time.Since(start).Milliseconds())
+	rh.log.Debug("%s: duration: %.2f", cmd.String(), durationMs)
+	if err != nil {
+		return "", fmt.Errorf("error identify colorspace %w", err)
+	}
+
+	return strings.TrimSpace(string(res)), nil
+}
@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DefaultMaxPages = 500
+const DefaultDocumentDensity = 150
+const DefaultContactSheetSpacing = 8
+
+const PDFFormat = "pdf"
+
+// multi-page originals, see needsRasterization
+var documentFormats = map[string]bool{
+	"pdf":  true,
+	"tiff": true,
+	"tif":  true,
+}
+
+// coders of documents, explicit so nothing else decodes the file
+var documentCoders = map[string]string{
+	"pdf":  "PDF",
+	"tiff": "TIFF",
+	"tif":  "TIFF",
+}
+
+// coderInput pins the coder of documents, other originals are decoded by
+// what their content is as stored files don't always match the declared format
+func coderInput(filename, format string) string {
+	coder, ok := documentCoders[format]
+	if !ok {
+		return filename
+	}
+
+	return fmt.Sprintf("%s:%s", coder, filename)
+}
+
+// needsRasterization tells whether the document is rendered before the size
+// chain, single-page tiffs are regular images and keep their alpha
+func (rh *ResizeHandler) needsRasterization(pages int) bool {
+	return rh.Request.Format == PDFFormat || pages > 1 || rh.Request.Document != nil
+}
+
+func (rh *ResizeHandler) getPageCount(filename string) (int, error) {
+	cmd := exec.Command(
+		"identify",
+		"-limit",
+		"memory",
+		rh.memoryLimit,
+		"-limit",
+		"time",
+		rh.timeout,
+		"-quiet",
+		// ping reads page headers without rendering any page
+		"-ping",
+		"-format",
+		"%n\n",
+		coderInput(filename, rh.Request.Format))
+	rh.log.Debug(cmd.String())
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, err
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Split(bufio.ScanLines)
+
+	// %n is printed for every page, the first line is enough
+	pages := 0
+	for scanner.Scan() {
+		if pages == 0 {
+			pages, _ = strconv.Atoi(strings.TrimSpace(scanner.Text()))
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	// the pinned coder fails on content of another format
+	if err := cmd.Wait(); err != nil {
+		return 0, fmt.Errorf("%w: original is not a readable %s: %v", ErrInvalidInput, rh.Request.Format, err)
+	}
+
+	return pages, nil
+}
+
+// rasterizeDocument renders the selected page, or a contact sheet of the
+// selected range, into a lossless image used as the original afterwards
+func (rh *ResizeHandler) rasterizeDocument(filename string, pages int) (string, error) {
+	start := time.Now()
+	if pages > rh.maxPages {
+		return "", fmt.Errorf("%w: %d pages exceed limit of %d", ErrInvalidInput, pages, rh.maxPages)
+	}
+
+	first, last := 1, 1
+	density := DefaultDocumentDensity
+	columns := 0
+	if opt := rh.Request.Document; opt != nil {
+		if opt.Page > 0 {
+			first = int(opt.Page)
+			last = first
+		}
+		if opt.LastPage > 0 {
+			last = int(opt.LastPage)
+		}
+		if opt.Density > 0 {
+			density = int(opt.Density)
+		}
+		columns = int(opt.Columns)
+	}
+	if last > pages {
+		return "", fmt.Errorf("%w: page %d requested, document has %d pages", ErrInvalidInput, last, pages)
+	}
+
+	result := rh.generateRandomFileName(DefaultLosslessFormat)
+	commonArgs := []string{
+		"-limit",
+		"memory",
+		rh.memoryLimit,
+		"-limit",
+		"time",
+		rh.timeout,
+		"-density",
+		strconv.Itoa(density),
+	}
+	var cmd *exec.Cmd
+	if first == last {
+		cmd = exec.Command(
+			"magick",
+			append(
+				commonArgs,
+				fmt.Sprintf("%s[%d]", filename, first-1),
+				"-background",
+				"white",
+				"-alpha",
+				"remove",
+				"-alpha",
+				"off",
+				result,
+			)...,
+		)
+	} else {
+		count := last - first + 1
+		if columns == 0 {
+			columns = int(math.Ceil(math.Sqrt(float64(count))))
+		}
+		cmd = exec.Command(
+			"magick",
+			append(
+				append([]string{"montage"}, commonArgs...),
+				fmt.Sprintf("%s[%d-%d]", filename, first-1, last-1),
+				"-background",
+				"white",
+				"-tile",
+				fmt.Sprintf("%dx", columns),
+				"-geometry",
+				fmt.Sprintf("+%d+%d", DefaultContactSheetSpacing, DefaultContactSheetSpacing),
+				result,
+			)...,
+		)
+	}
+
+	res, err := cmd.CombinedOutput()
+	durationMs := float64(time.Since(start).Milliseconds())
+	rh.log.Debug("%s: duration: %.2f", cmd.String(), durationMs)
+	if string(res) != "" {
+		rh.log.Debug(string(res))
+	}
+	if err != nil {
+		return "", fmt.Errorf("error rasterize document %w, command output: %s", err, res)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"errors"
+	"sync"
+)
+
+var errFlightAborted = errors.New("shared call aborted")
+
+// flightGroup runs a function once per key at a time, concurrent callers
+// with the same key wait for and share the result of the running call
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	wg  sync.WaitGroup
+	val any
+	err error
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{
+		calls: map[string]*flightCall{},
+	}
+}
+
+// Do returns the result of fn and whether it was shared with another caller
+func (g *flightGroup) Do(key string, fn func() (any, error)) (any, error, bool) {
+	g.mu.Lock()
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		call.wg.Wait()
+		return call.val, call.err, true
+	}
+	call := &flightCall{}
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		call.wg.Done()
+	}()
+	// stays set if fn panics, waiters must not get a nil result without an error
+	call.err = errFlightAborted
+	call.val, call.err = fn()
+
+	return call.val, call.err, false
+}
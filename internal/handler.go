@@ -2,7 +2,11 @@ package internal
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"os/exec"
 	"sort"
@@ -12,6 +16,8 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
@@ -21,17 +27,27 @@ import (
 
 const DefaultJpegFormat = "jpeg"
 const DefaultColorProfileFormat = "icc"
-const DefaultWatermarkQuality = 100
-const DefaultWatermarkDissolve = "100"
 const DefaultResizerFilter = "Lanczos2"
 const DefaultResizerCommandMemoryLimit = 250
 const DefaultResizerCommandTimeLimit = 45
 
+// ErrInvalidInput marks failures caused by the submitted image rather than by the service
+var ErrInvalidInput = errors.New("invalid input")
+
+// errors of failed sizes in partial responses
+const (
+	sizeErrorProcessing = "processing failed"
+	sizeErrorUpload     = "upload failed"
+	sizeErrorInvalid    = "invalid input"
+)
+
 var formatToMimeType = map[string]string{
 	"jpeg": "image/jpeg",
 	"png":  "image/png",
 	"jpg":  "image/jpeg",
 	"webp": "image/webp",
+	"gif":  "image/gif",
+	"avif": "image/avif",
 }
 
 func NewResizeHandler(request pkg.Request, stdLog *StdLog, provider *WatermarkProvider, config ResizerConfig) *ResizeHandler {
@@ -43,6 +59,54 @@ func NewResizeHandler(request pkg.Request, stdLog *StdLog, provider *WatermarkPr
 		config.MemoryMB = DefaultResizerCommandMemoryLimit
 	}
 
+	if config.MaxFrames == 0 {
+		config.MaxFrames = DefaultMaxFrames
+	}
+
+	if config.MaxTotalPixels == 0 {
+		config.MaxTotalPixels = DefaultMaxTotalPixels
+	}
+
+	if config.MaxPages == 0 {
+		config.MaxPages = DefaultMaxPages
+	}
+
+	if config.MaxSVGElements == 0 {
+		config.MaxSVGElements = DefaultMaxSVGElements
+	}
+
+	if config.FontDir == "" {
+		config.FontDir = DefaultFontDir
+	}
+
+	if config.OutputProfile == "" {
+		config.OutputProfile = DefaultOutputProfile
+	}
+
+	// zero jitter is valid, it is only defaulted with an unset config
+	if config.Retry == (RetryConfig{}) {
+		config.Retry.Jitter = DefaultRetryJitter
+	}
+
+	if config.Retry.Attempts == 0 {
+		config.Retry.Attempts = DefaultRetryAttempts
+	}
+
+	if config.Retry.BaseDelay == 0 {
+		config.Retry.BaseDelay = DefaultRetryBaseDelay
+	}
+
+	if config.Retry.MaxDelay == 0 {
+		config.Retry.MaxDelay = DefaultRetryMaxDelay
+	}
+
+	// pdf and svg are always rasterized into a lossless original, rasterized
+	// tiffs stay tiff so keep_format doesn't depend on the page count
+	originalFormat := request.Format
+	if request.Format == PDFFormat || request.Format == SVGFormat {
+		originalFormat = DefaultLosslessFormat
+	}
+
 	return &ResizeHandler{
 		Request:           request,
 		log:               stdLog,
@@ -51,12 +115,35 @@ func NewResizeHandler(request pkg.Request, stdLog *StdLog, provider *WatermarkPr
 		watermarkProvider: provider,
 		memoryLimit:       fmt.Sprintf("%dMB", config.MemoryMB),
 		timeout:           strconv.Itoa(config.TimeoutSec),
+		maxFrames:         config.MaxFrames,
+		maxTotalPixels:    config.MaxTotalPixels,
+		maxPages:          config.MaxPages,
+		maxSVGElements:    config.MaxSVGElements,
+		fontDir:           config.FontDir,
+		outputProfile:     config.OutputProfile,
+		retry:             config.Retry,
+		frames:            1,
+		originalFormat:    originalFormat,
+		stagingID:         uuid.New().String(),
 	}
 }
 
 type ResizerConfig struct {
 	MemoryMB   int
 	TimeoutSec int
+	// MaxFrames and MaxTotalPixels limit animated originals
+	MaxFrames      int
+	MaxTotalPixels int64
+	// MaxPages limits multi-page document originals
+	MaxPages int
+	// MaxSVGElements limits complexity of svg originals
+	MaxSVGElements int
+	// FontDir holds fonts available to text watermarks
+	FontDir string
+	// Retry applies to storage reads, writes and deletes
+	Retry RetryConfig
+	// OutputProfile is the ICC profile colors are converted into on request
+	OutputProfile string
 }
 
 type ResizeHandler struct {
@@ -68,91 +155,381 @@ type ResizeHandler struct {
 	session           *session.Session
 	memoryLimit       string
 	timeout           string
+	maxFrames         int
+	maxTotalPixels    int64
+	maxPages          int
+	maxSVGElements    int
+	fontDir           string
+	outputProfile     string
+	retry             RetryConfig
+	// frames of the downloaded original
+	frames int
+	// format of the original after preparation, used by keep_format sizes
+	originalFormat string
+	// stagingID separates staged outputs of atomic requests
+	stagingID string
 }
 
-func (rh *ResizeHandler) ProcessRequest() (map[string]pkg.ResultSize, error) {
+// ProcessRequest stops between steps once ctx is done, a started
+// ImageMagick command is bounded by its own time limit
+func (rh *ResizeHandler) ProcessRequest(ctx context.Context) (*pkg.Response, error) {
 	rh.log.Debug("Processing request %v", rh.Request)
 	start := time.Now()
+	response := &pkg.Response{}
+	result := map[string]pkg.ResultSize{}
+	var sourceETag string
+	var err error
+	if rh.Request.Reprocess != "" {
+		sourceETag, result, err = rh.findUpToDateSizes()
+		if err != nil {
+			return nil, fmt.Errorf("process request error: %w", err)
+		}
+		if len(result) == len(rh.Request.Sizes) && !rh.needsOriginal() {
+			rh.log.Debug("RESIZE SKIPPED for: %s", rh.Request.OriginalPath)
+			response.Sizes = result
+			return response, nil
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("process request error: %w", err)
+	}
 	originalFileName := rh.generateRandomFileName(rh.Request.Format)
-	err := rh.downloadFromS3(rh.Request.BucketName, rh.Request.OriginalPath, originalFileName, rh.Request.Region)
+	// the original must not change between the lookup of stored outputs and
+	// the download, its ETag is stored with every output for later if_stale runs
+	sourceETag, err = rh.downloadFromS3(rh.Request.BucketName, rh.Request.OriginalPath, originalFileName, rh.Request.Region, sourceETag)
 	if err != nil {
 		return nil, fmt.Errorf("process request error: %w", err)
 	}
+	downloadedFileName := originalFileName
+	if animatedFormats[rh.Request.Format] {
+		animation, err := rh.getAnimationInfo(originalFileName)
+		if err != nil {
+			return nil, fmt.Errorf("process request error: %w", err)
+		}
+		err = rh.checkAnimationLimits(animation)
+		if err != nil {
+			return nil, fmt.Errorf("process request error: %w", err)
+		}
+		rh.frames = animation.frames
+		if rh.isAnimated() {
+			err = rh.checkAnimationTransform()
+			if err != nil {
+				return nil, fmt.Errorf("process request error: %w", err)
+			}
+		}
+	}
+	// format of the file the size chain starts from
+	inputFormat := rh.Request.Format
+	if documentFormats[rh.Request.Format] {
+		response.Pages, err = rh.getPageCount(originalFileName)
+		if err != nil {
+			return nil, fmt.Errorf("process request error: %w", err)
+		}
+		if rh.needsRasterization(response.Pages) {
+			originalFileName, err = rh.rasterizeDocument(coderInput(originalFileName, rh.Request.Format), response.Pages)
+			if err != nil {
+				return nil, fmt.Errorf("process request error: %w", err)
+			}
+			inputFormat = DefaultLosslessFormat
+		}
+	}
+	if rh.Request.Format == SVGFormat {
+		originalFileName, err = rh.rasterizeSVG(originalFileName)
+		if err != nil {
+			return nil, fmt.Errorf("process request error: %w", err)
+		}
+		inputFormat = DefaultLosslessFormat
+	}
 	rh.log.Debug("RESIZE STARTED for: %s", rh.Request.OriginalPath)
 	sortedSizes := rh.getSortSizes()
 	// resize options is required field
-	err = rh.stripAndRotateOriginal(originalFileName, originalFileName, *sortedSizes[0].ResizeOptions)
+	preparedFileName := rh.generateRandomFileName(rh.originalFormat)
+	err = rh.stripAndRotateOriginal(coderInput(originalFileName, inputFormat), preparedFileName, *sortedSizes[0].ResizeOptions)
 	if err != nil {
 		return nil, fmt.Errorf("process request error: %w", err)
 	}
-	result := map[string]pkg.ResultSize{}
-	var wg sync.WaitGroup
-	hasUploadError := false
-	wg.Add(len(rh.Request.Sizes))
-	for _, size := range sortedSizes {
-		format := rh.Request.Format
-		if size.Format != "" {
-			format = size.Format
-		} else if !size.KeepFormat {
-			format = DefaultJpegFormat
+	if needsMetadata(rh.Request.Metadata) {
+		// tags come from the downloaded file, rasterized documents have none
+		err = rh.metadataCommand(downloadedFileName, preparedFileName, rh.Request.Metadata)
+		if err != nil {
+			return nil, fmt.Errorf("process request error: %w", err)
 		}
-		toSave, newOriginal, err := rh.processSize(originalFileName, format, size)
+	}
+	originalFileName = preparedFileName
+	if len(rh.Request.Placeholders) > 0 {
+		response.Placeholders, err = rh.generatePlaceholders(originalFileName)
 		if err != nil {
 			return nil, fmt.Errorf("process request error: %w", err)
 		}
-		path := fmt.Sprintf("%s/%s.%s", rh.Request.PathToSave, size.SizeName, format)
-		info, err := rh.getResultFileInfo(toSave, path)
+	}
+	if rh.Request.Palette != nil {
+		response.Palette, err = rh.getPalette(originalFileName, rh.Request.Palette)
 		if err != nil {
 			return nil, fmt.Errorf("process request error: %w", err)
 		}
+		response.DominantColor = response.Palette[0].Color
+	}
+	if len(rh.Request.Hashes) > 0 {
+		// the downloaded original as the hash endpoint sees it, transforms and
+		// crops of this request must not change the hashes
+		input, err := rh.inspectedInput(downloadedFileName)
+		if err != nil {
+			return nil, fmt.Errorf("process request error: %w", err)
+		}
+		response.Hashes, err = rh.getHashes(input, rh.Request.Hashes)
+		if err != nil {
+			return nil, fmt.Errorf("process request error: %w", err)
+		}
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	uploadErrors := map[string]error{}
+	for _, size := range sortedSizes {
+		if _, ok := result[size.SizeName]; ok {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			wg.Wait()
+			return nil, fmt.Errorf("process request error: %w", err)
+		}
+		format := rh.outputFormat(size)
+		info, processed, err := rh.generateSize(originalFileName, format, size)
+		if err != nil {
+			if !rh.Request.Partial {
+				wg.Wait()
+				return nil, fmt.Errorf("process request error: %w", err)
+			}
+			rh.log.Error("process request error: size %s: %v", size.SizeName, err)
+			result[size.SizeName] = failedSize(err, sizeErrorProcessing)
+			continue
+		}
 		result[size.SizeName] = *info
-		originalFileName = newOriginal
+		originalFileName = processed.newOriginal
+		if info.Deduplicated {
+			// stored by an earlier request, so it isn't ours to clean up either
+			continue
+		}
+		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			err = rh.uploadToS3(rh.Request.BucketName, format, path, toSave, rh.Request.Region)
+			metadata := rh.outputMetadata(size, format, sourceETag, info)
+			err := rh.uploadToS3(ctx, rh.Request.BucketName, format, rh.uploadKey(info.Path), processed.file, rh.Request.Region, metadata)
 			if err != nil {
-				hasUploadError = true
-				rh.log.Error("process request error: %w", err)
+				rh.log.Error("process request error: size %s: %v", size.SizeName, err)
+				mu.Lock()
+				uploadErrors[size.SizeName] = err
+				mu.Unlock()
 			}
 		}()
 	}
 	wg.Wait()
 	rh.log.Debug("RESIZE COMPLETED for: %s", rh.Request.OriginalPath)
-	if hasUploadError {
+	if len(uploadErrors) > 0 && !rh.Request.Partial {
 		return nil, fmt.Errorf("process request error: files failed to uploade to S3")
 	}
+	for sizeName, err := range uploadErrors {
+		result[sizeName] = failedSize(err, sizeErrorUpload)
+	}
+	if !hasSucceededSize(result) {
+		if allSizesInvalid(result) {
+			return nil, fmt.Errorf("process request error: %w: all %d sizes failed", ErrInvalidInput, len(result))
+		}
+		return nil, fmt.Errorf("process request error: all %d sizes failed", len(result))
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("process request error: %w", err)
+	}
+	if rh.Request.Atomic {
+		err = rh.publishStaged(result)
+		if err != nil {
+			return nil, fmt.Errorf("process request error: %w", err)
+		}
+	}
 	durationMs := float64(time.Since(start).Milliseconds())
 	resizeDuration.Observe(durationMs)
-	return result, nil
+	response.Sizes = result
+	return response, nil
+}
+
+// generateSize processes the size and describes the output to upload
+func (rh *ResizeHandler) generateSize(originalFileName, format string, size pkg.Size) (*pkg.ResultSize, *processedSize, error) {
+	processed, err := rh.processSize(originalFileName, format, size)
+	if err != nil {
+		return nil, nil, err
+	}
+	// animated outputs print the format once per frame, the first one is enough
+	info, err := rh.getResultFileInfo(posterFrame(processed.file), "")
+	if err != nil {
+		return nil, nil, err
+	}
+	info.Path, err = rh.outputKey(size, format, processed.file, info.Width)
+	if err != nil {
+		return nil, nil, err
+	}
+	info.Status = pkg.SizeStatusGenerated
+	if pkg.IsContentAddressed(rh.Request.KeyTemplate) {
+		info.Deduplicated, err = rh.objectExists(rh.Request.BucketName, info.Path, rh.Request.Region)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if processed.quality != nil {
+		info.Quality = processed.quality.quality
+		info.SSIM = processed.quality.ssim
+	}
+	if processed.animated {
+		animation, err := rh.getAnimationInfo(processed.file)
+		if err != nil {
+			return nil, nil, err
+		}
+		info.Frames = animation.frames
+		info.DurationMs = animation.durationMs
+	}
+
+	return info, processed, nil
+}
+
+// failedSize reports the size in partial mode, details of the error stay in
+// the log as they may name files and buckets
+func failedSize(err error, message string) pkg.ResultSize {
+	if errors.Is(err, ErrInvalidInput) {
+		message = sizeErrorInvalid
+	}
+
+	return pkg.ResultSize{
+		Status: pkg.SizeStatusFailed,
+		Error:  message,
+	}
+}
+
+func hasSucceededSize(result map[string]pkg.ResultSize) bool {
+	for _, size := range result {
+		if size.Status != pkg.SizeStatusFailed {
+			return true
+		}
+	}
+
+	return false
 }
 
-func (rh *ResizeHandler) processSize(originalFilename, format string, size pkg.Size) (string, string, error) {
-	resizedFileName := rh.generateRandomFileName(format)
-	err := rh.resizeCommand(originalFilename, resizedFileName, true, size.ResizeOptions)
+// allSizesInvalid tells a request which can never succeed from one which
+// may succeed on a retry
+func allSizesInvalid(result map[string]pkg.ResultSize) bool {
+	for _, size := range result {
+		if size.Error != sizeErrorInvalid {
+			return false
+		}
+	}
+
+	return len(result) > 0
+}
+
+// outputFormat resolves the format a size is stored in
+func (rh *ResizeHandler) outputFormat(size pkg.Size) string {
+	format := rh.originalFormat
+	if size.Format != "" {
+		format = size.Format
+	} else if !size.KeepFormat {
+		format = DefaultJpegFormat
+	}
+
+	return maskFormat(format, size.Mask)
+}
+
+type processedSize struct {
+	file        string
+	newOriginal string
+	quality     *qualityResult
+	animated    bool
+}
+
+func (rh *ResizeHandler) processSize(originalFilename, format string, size pkg.Size) (*processedSize, error) {
+	animated := rh.preservesAnimation(size, format)
+	input := originalFilename
+	if rh.isAnimated() && !animated {
+		input = posterFrame(originalFilename)
+	}
+	// with quality targeting the chain works losslessly and is encoded once at the end
+	workFormat := format
+	targetSSIM := size.ResizeOptions.TargetSSIM > 0 && lossyFormats[format] && !animated
+	if targetSSIM {
+		workFormat = DefaultLosslessFormat
+	}
+	resizedFileName := rh.generateRandomFileName(workFormat)
+	err := rh.resizeCommand(input, resizedFileName, true, animated, size.ResizeOptions)
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
 	finalFileName := resizedFileName
 
 	if size.CropOptions != nil {
-		cropFileName := rh.generateRandomFileName(format)
-		err = rh.cropCommand(finalFileName, cropFileName, size.CropOptions)
+		cropFileName := rh.generateRandomFileName(workFormat)
+		err = rh.cropCommand(finalFileName, cropFileName, animated, size.CropOptions)
 		if err != nil {
-			return "", "", err
+			return nil, err
 		}
 		finalFileName = cropFileName
 	}
 
-	if size.WaterMarkOptions != nil {
-		watermarkedFileName := rh.generateRandomFileName(format)
-		err := rh.waterMarkCommand(finalFileName, watermarkedFileName, size.WaterMarkOptions)
+	if len(size.Adjustments) > 0 {
+		adjustedFileName := rh.generateRandomFileName(workFormat)
+		err = rh.adjustCommand(finalFileName, adjustedFileName, animated, size.Adjustments)
+		if err != nil {
+			return nil, err
+		}
+		finalFileName = adjustedFileName
+	}
+
+	if watermarks := size.WaterMarkLayers(); len(watermarks) > 0 {
+		watermarkedFileName := rh.generateRandomFileName(workFormat)
+		err := rh.waterMarkCommand(finalFileName, watermarkedFileName, animated, watermarks)
 		if err != nil {
-			return "", "", err
+			return nil, err
 		}
 		finalFileName = watermarkedFileName
 	}
 
-	return finalFileName, resizedFileName, nil
+	if size.Mask != nil {
+		maskedFileName := rh.generateRandomFileName(workFormat)
+		err := rh.maskCommand(finalFileName, maskedFileName, animated, size.Mask)
+		if err != nil {
+			return nil, err
+		}
+		finalFileName = maskedFileName
+	}
+
+	processed := &processedSize{
+		file:        finalFileName,
+		newOriginal: resizedFileName,
+		animated:    animated,
+	}
+	// a poster frame can't feed the next size if that one needs the animation
+	if rh.isAnimated() && !animated {
+		processed.newOriginal = originalFilename
+	}
+	if targetSSIM {
+		processed.file, processed.quality, err = rh.encodeWithTargetSSIM(finalFileName, format, size.ResizeOptions)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return processed, nil
+}
+
+// inspectedInput is the downloaded original as passed to ImageMagick when it
+// is only inspected, svg goes through sanitization like in resizes
+func (rh *ResizeHandler) inspectedInput(filename string) (string, error) {
+	if rh.Request.Format != SVGFormat {
+		return coderInput(filename, rh.Request.Format), nil
+	}
+	sanitized := rh.generateRandomFileName(SVGFormat)
+	err := rh.sanitizeSVGFile(filename, sanitized)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s:%s", svgCoder, sanitized), nil
 }
 
 func (rh *ResizeHandler) generateRandomFileName(format string) string {
@@ -187,11 +564,14 @@ func (rh *ResizeHandler) CleanupOnError() {
 	s3Client := s3.New(rh.session)
 	rh.cleanUpAwsFiles.Range(func(_, value any) bool {
 		toDelete := value.(string)
-		_, err = s3Client.DeleteObject(
-			&s3.DeleteObjectInput{
-				Bucket: aws.String(rh.Request.BucketName),
-				Key:    aws.String(toDelete),
-			})
+		err = rh.withRetry("delete", func() error {
+			_, err := s3Client.DeleteObject(
+				&s3.DeleteObjectInput{
+					Bucket: aws.String(rh.Request.BucketName),
+					Key:    aws.String(toDelete),
+				})
+			return err
+		})
 		if err != nil {
 			rh.log.Error("failed to delete on error: %v", err)
 		}
@@ -218,7 +598,9 @@ func (a sortBySize) Less(i, j int) bool {
 	return (a[i].ResizeOptions.X > a[j].ResizeOptions.X) && (a[i].ResizeOptions.Y >= a[j].ResizeOptions.Y)
 }
 
-func (rh *ResizeHandler) downloadFromS3(bucketName, path, result string, region string) error {
+// downloadFromS3 fetches the object and returns its ETag, a non-empty ifMatch
+// fails the download when the object has another ETag
+func (rh *ResizeHandler) downloadFromS3(bucketName, path, result string, region string, ifMatch string) (string, error) {
 	// Create a new AWS session
 	var err error
 	if rh.session == nil {
@@ -226,7 +608,7 @@ func (rh *ResizeHandler) downloadFromS3(bucketName, path, result string, region
 			Region: aws.String(region), // replace with your desired region
 		})
 		if err != nil {
-			return fmt.Errorf("failed to create session: %w", err)
+			return "", fmt.Errorf("failed to create session: %w", err)
 		}
 	}
 	// Create a new S3 manager
@@ -235,24 +617,49 @@ func (rh *ResizeHandler) downloadFromS3(bucketName, path, result string, region
 	// Open a file for writing
 	file, err := os.Create(result)
 	if err != nil {
-		return fmt.Errorf("failed to create file %q, %v", result, err)
+		return "", fmt.Errorf("failed to create file %q, %v", result, err)
 	}
+	defer file.Close()
 
-	// Download the object using the S3 manager
-	_, err = downloader.Download(file,
-		&s3.GetObjectInput{
+	// ranges are fetched concurrently, each response carries the same ETag
+	var mu sync.Mutex
+	var etag string
+	recordETag := func(r *request.Request) {
+		r.Handlers.Complete.PushBack(func(r *request.Request) {
+			if r.Error != nil || r.HTTPResponse == nil {
+				return
+			}
+			mu.Lock()
+			etag = r.HTTPResponse.Header.Get("ETag")
+			mu.Unlock()
+		})
+	}
+
+	// Download the object using the S3 manager, a retry writes the same ranges again
+	err = rh.withRetry("download", func() error {
+		input := &s3.GetObjectInput{
 			Bucket: aws.String(bucketName),
 			Key:    aws.String(path),
-		})
+		}
+		if ifMatch != "" {
+			input.IfMatch = aws.String(ifMatch)
+		}
+		_, err := downloader.Download(file, input, s3manager.WithDownloaderRequestOptions(recordETag))
+		return err
+	})
+	var failure awserr.RequestFailure
+	if errors.As(err, &failure) && failure.StatusCode() == http.StatusPreconditionFailed {
+		return "", fmt.Errorf("original %q changed while processing", path)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to download file, %v", err)
+		return "", fmt.Errorf("failed to download file, %v", err)
 	}
 
 	rh.log.Debug("Receive file from S3 %s", path)
-	return nil
+	return etag, nil
 }
 
-func (rh *ResizeHandler) uploadToS3(bucketName, format, path, filename string, region string) error {
+func (rh *ResizeHandler) uploadToS3(ctx context.Context, bucketName, format, path, filename string, region string, metadata map[string]*string) error {
 	// Create a new AWS session
 	var err error
 	if rh.session == nil {
@@ -271,13 +678,19 @@ func (rh *ResizeHandler) uploadToS3(bucketName, format, path, filename string, r
 	if err != nil {
 		return fmt.Errorf("failed to open file %q, %v", filename, err)
 	}
+	defer file.Close()
 
 	uinp := &s3manager.UploadInput{
 		Bucket: aws.String(bucketName),
 		Key:    aws.String(path),
 		Body:   file,
 		// TODO: fix it changing Cloudfront settings
-		ACL: aws.String("public-read"),
+		ACL:      aws.String("public-read"),
+		Metadata: metadata,
+	}
+
+	if pkg.IsContentAddressed(rh.Request.KeyTemplate) {
+		uinp.CacheControl = aws.String(ImmutableCacheControl)
 	}
 
 	mimeType := rh.getMimeTypeFromFormat(format)
@@ -285,14 +698,25 @@ func (rh *ResizeHandler) uploadToS3(bucketName, format, path, filename string, r
 		uinp.ContentType = aws.String(mimeType)
 	}
 
-	// Upload the file to S3
-	_, err = uploader.Upload(uinp)
+	// Upload the file to S3, a retry reads it from the start
+	err = rh.withRetry("upload", func() error {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := uploader.UploadWithContext(ctx, uinp)
+		return err
+	})
 	if err != nil {
 		return fmt.Errorf("failed to upload file, %v", err)
 	}
 
 	rh.log.Debug("Put file to S3 %s", path)
-	rh.cleanUpAwsFiles.Store(path, path)
+	// content-addressed keys may already be returned to concurrent requests
+	// and are never deleted, orphans are left to a bucket lifecycle rule;
+	// staged copies of atomic requests are ours alone
+	if !pkg.IsContentAddressed(rh.Request.KeyTemplate) || rh.Request.Atomic {
+		rh.cleanUpAwsFiles.Store(path, path)
+	}
 	return nil
 }
 
@@ -305,7 +729,8 @@ func (rh *ResizeHandler) stripAndRotateOriginal(filename, result string, opt pkg
 	if err != nil {
 		return fmt.Errorf("error stripAndRotateOriginal %w", err)
 	}
-	if hasColorProfile {
+	convert := rh.Request.Color != nil && rh.Request.Color.Convert
+	if hasColorProfile && !convert {
 		profileFileName = rh.generateRandomFileName(DefaultColorProfileFormat)
 		cmd = exec.Command(
 			"magick",
@@ -326,6 +751,10 @@ func (rh *ResizeHandler) stripAndRotateOriginal(filename, result string, opt pkg
 		}
 	}
 
+	input := filename
+	if rh.isAnimated() && !rh.anySizePreservesAnimation() {
+		input = posterFrame(filename)
+	}
 	commonArgs := []string{
 		"-limit",
 		"memory",
@@ -333,16 +762,33 @@ func (rh *ResizeHandler) stripAndRotateOriginal(filename, result string, opt pkg
 		"-limit",
 		"time",
 		rh.timeout,
-		filename,
+		input,
+	}
+	if rh.isAnimated() {
+		commonArgs = append(commonArgs, "-coalesce")
+	}
+	if convert {
+		colorArgs, err := rh.colorConversionArgs(filename, hasColorProfile)
+		if err != nil {
+			return fmt.Errorf("error stripAndRotateOriginal %w", err)
+		}
+		commonArgs = append(commonArgs, colorArgs...)
+	}
+	// orient first, so transforms and the resize box apply to the image as it is viewed
+	commonArgs = append(commonArgs, "-auto-orient")
+	commonArgs = append(commonArgs, rh.transformArgs(rh.Request.Transform)...)
+	commonArgs = append(commonArgs,
 		"-resize",
 		fmt.Sprintf("%dx%d", opt.X, opt.Y),
-		"-auto-orient",
 		"-strip",
-	}
+	)
 
 	if hasColorProfile && profileFileName != "" {
 		commonArgs = append(commonArgs, "-profile", profileFileName)
 	}
+	if convert && !rh.Request.Color.DropProfile {
+		commonArgs = append(commonArgs, "-profile", rh.outputProfile)
+	}
 	commonArgs = append(commonArgs, result)
 	cmd = exec.Command("magick", commonArgs...)
 
@@ -359,7 +805,7 @@ func (rh *ResizeHandler) stripAndRotateOriginal(filename, result string, opt pkg
 	return nil
 }
 
-func (rh *ResizeHandler) resizeCommand(filename, result string, forceBackground bool, opt *pkg.ResizeOptions) error {
+func (rh *ResizeHandler) resizeCommand(filename, result string, forceBackground, animated bool, opt *pkg.ResizeOptions) error {
 	start := time.Now()
 	commonArgs := []string{
 		"-limit",
@@ -371,6 +817,10 @@ func (rh *ResizeHandler) resizeCommand(filename, result string, forceBackground
 		filename,
 	}
 
+	if animated {
+		commonArgs = append(commonArgs, "-coalesce")
+	}
+
 	if forceBackground {
 		commonArgs = append(commonArgs, []string{
 			"-fill",
@@ -380,36 +830,29 @@ func (rh *ResizeHandler) resizeCommand(filename, result string, forceBackground
 		}...)
 	}
 
-	cmd := exec.Command(
-		"magick",
-		append(
-			commonArgs,
-			[]string{
-				"-resize",
-				fmt.Sprintf("%dx%d", opt.X, opt.Y),
-				"-filter",
-				DefaultResizerFilter,
-				"-quality",
-				fmt.Sprintf("%d", opt.ImageQuality),
-				result,
-			}...,
-		)...,
-	)
+	resizeArgs := []string{
+		"-resize",
+		fmt.Sprintf("%dx%d", opt.X, opt.Y),
+		"-filter",
+		DefaultResizerFilter,
+	}
 	if opt.QuickResize {
-		cmd = exec.Command(
-			"magick",
-			append(
-				commonArgs,
-				[]string{
-					"-scale",
-					fmt.Sprintf("%dx%d", opt.X, opt.Y),
-					"-quality",
-					fmt.Sprintf("%d", opt.ImageQuality),
-					result,
-				}...,
-			)...,
-		)
+		resizeArgs = []string{
+			"-scale",
+			fmt.Sprintf("%dx%d", opt.X, opt.Y),
+		}
+	}
+	args := append(commonArgs, resizeArgs...)
+	if animated {
+		args = append(args, "-layers", "Optimize")
 	}
+	args = append(args,
+		"-quality",
+		fmt.Sprintf("%d", opt.ImageQuality),
+		result,
+	)
+
+	cmd := exec.Command("magick", args...)
 	res, err := cmd.CombinedOutput()
 	durationMs := float64(time.Since(start).Milliseconds())
 	rh.log.Debug("%s: duration: %.2f", cmd.String(), durationMs)
@@ -424,10 +867,9 @@ func (rh *ResizeHandler) resizeCommand(filename, result string, forceBackground
 	return nil
 }
 
-func (rh *ResizeHandler) cropCommand(filename, result string, opt *pkg.CropOptions) error {
+func (rh *ResizeHandler) cropCommand(filename, result string, animated bool, opt *pkg.CropOptions) error {
 	start := time.Now()
-	cmd := exec.Command(
-		"magick",
+	args := []string{
 		"-limit",
 		"memory",
 		rh.memoryLimit,
@@ -435,49 +877,21 @@ func (rh *ResizeHandler) cropCommand(filename, result string, opt *pkg.CropOptio
 		"time",
 		rh.timeout,
 		filename,
-		"-crop",
-		fmt.Sprintf("%dx%d+%d+%d", opt.Width, opt.Height, opt.X, opt.Y),
-		result)
-	res, err := cmd.CombinedOutput()
-	durationMs := float64(time.Since(start).Milliseconds())
-	rh.log.Debug("%s: duration: %.2f", cmd.String(), durationMs)
-	if string(res) != "" {
-		rh.log.Debug(string(res))
 	}
-	if err != nil {
-		return fmt.Errorf("error crop file %w, command output: %s", err, res)
+	if animated {
+		args = append(args, "-coalesce")
 	}
-
-	return nil
-}
-
-func (rh *ResizeHandler) waterMarkCommand(filename, result string, opt *pkg.WaterMarkOptions) error {
-	start := time.Now()
-	watermarkPath, watermarkFormat, err := rh.watermarkProvider.GetWatermark(opt.WatermarkImageURL)
-	if err != nil {
-		return fmt.Errorf("error add watermark to file %w", err)
-	}
-	watermarkImage := rh.generateRandomFileName(watermarkFormat)
-	err = rh.resizeCommand(watermarkPath, watermarkImage, false, &pkg.ResizeOptions{
-		ImageQuality: DefaultWatermarkQuality,
-		QuickResize:  false,
-		X:            opt.Width,
-		Y:            opt.Height,
-	})
-	if err != nil {
-		return fmt.Errorf("error add watermark to file %w", err)
+	// +repage drops the virtual canvas offsets left by crop
+	args = append(args,
+		"-crop",
+		fmt.Sprintf("%dx%d+%d+%d", opt.Width, opt.Height, opt.X, opt.Y),
+		"+repage",
+	)
+	if animated {
+		args = append(args, "-layers", "Optimize")
 	}
-	cmd := exec.Command(
-		"composite",
-		"-dissolve",
-		DefaultWatermarkDissolve,
-		"-gravity",
-		"northwest",
-		"-geometry",
-		fmt.Sprintf("+%d+%d", opt.X, opt.Y),
-		watermarkImage,
-		filename,
-		result)
+	args = append(args, result)
+	cmd := exec.Command("magick", args...)
 	res, err := cmd.CombinedOutput()
 	durationMs := float64(time.Since(start).Milliseconds())
 	rh.log.Debug("%s: duration: %.2f", cmd.String(), durationMs)
@@ -485,7 +899,7 @@ func (rh *ResizeHandler) waterMarkCommand(filename, result string, opt *pkg.Wate
 		rh.log.Debug(string(res))
 	}
 	if err != nil {
-		return fmt.Errorf("error add watermark to file %w, command output: %s", err, res)
+		return fmt.Errorf("error crop file %w, command output: %s", err, res)
 	}
 
 	return nil
@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os/exec"
+	"sort"
+	"time"
+
+	"github.com/nocturnecity/image-resizer/pkg"
+)
+
+const hashSide = 8
+
+// pHash keeps the lowest 8x8 frequencies of a 32x32 DCT
+const perceptualHashSide = 32
+
+// getHashes computes 64-bit perceptual hashes of the first frame
+func (rh *ResizeHandler) getHashes(filename string, hashes []string) (map[string]string, error) {
+	result := map[string]string{}
+	for _, hash := range hashes {
+		var value uint64
+		switch hash {
+		case pkg.HashAverage:
+			pixels, err := rh.hashPixels(filename, hashSide, hashSide)
+			if err != nil {
+				return nil, err
+			}
+			value = averageHash(pixels)
+		case pkg.HashDifference:
+			pixels, err := rh.hashPixels(filename, hashSide+1, hashSide)
+			if err != nil {
+				return nil, err
+			}
+			value = differenceHash(pixels)
+		case pkg.HashPerceptual:
+			pixels, err := rh.hashPixels(filename, perceptualHashSide, perceptualHashSide)
+			if err != nil {
+				return nil, err
+			}
+			value = perceptualHash(pixels)
+		}
+		result[hash] = fmt.Sprintf("%016x", value)
+	}
+
+	return result, nil
+}
+
+// hashPixels renders the image as viewed in grayscale of exactly the given
+// size, rows first
+func (rh *ResizeHandler) hashPixels(filename string, width, height int) ([]float64, error) {
+	start := time.Now()
+	cmd := exec.Command(
+		"magick",
+		"-limit",
+		"memory",
+		rh.memoryLimit,
+		"-limit",
+		"time",
+		rh.timeout,
+		posterFrame(filename),
+		"-auto-orient",
+		"-background",
+		"white",
+		"-flatten",
+		"-colorspace",
+		"Gray",
+		"-resize",
+		fmt.Sprintf("%dx%d!", width, height),
+		"-depth",
+		"8",
+		"gray:-")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	res, err := cmd.Output()
+	durationMs := float64(time.Since(start).Milliseconds())
+	rh.log.Debug("%s: duration: %.2f", cmd.String(), durationMs)
+	if err != nil {
+		return nil, fmt.Errorf("error render hash pixels %w, command output: %s", err, stderr.String())
+	}
+	if len(res) != width*height {
+		return nil, fmt.Errorf("error render hash pixels: got %d bytes for %dx%d", len(res), width, height)
+	}
+
+	pixels := make([]float64, len(res))
+	for i, value := range res {
+		pixels[i] = float64(value)
+	}
+
+	return pixels, nil
+}
+
+// averageHash sets bits of pixels brighter than the mean, first pixel is the highest bit
+func averageHash(pixels []float64) uint64 {
+	mean := 0.0
+	for _, value := range pixels {
+		mean += value
+	}
+	mean /= float64(len(pixels))
+
+	return thresholdBits(pixels, mean)
+}
+
+// differenceHash sets bits where a pixel is brighter than its left neighbour
+func differenceHash(pixels []float64) uint64 {
+	var hash uint64
+	for y := 0; y < hashSide; y++ {
+		for x := 0; x < hashSide; x++ {
+			hash <<= 1
+			if pixels[y*(hashSide+1)+x+1] > pixels[y*(hashSide+1)+x] {
+				hash |= 1
+			}
+		}
+	}
+
+	return hash
+}
+
+// perceptualHash sets bits of the low frequencies above their median
+func perceptualHash(pixels []float64) uint64 {
+	n := perceptualHashSide
+	// separable 2D DCT-II: rows first, then columns of the low frequencies only
+	rows := make([]float64, n*hashSide)
+	for y := 0; y < n; y++ {
+		for u := 0; u < hashSide; u++ {
+			sum := 0.0
+			for x := 0; x < n; x++ {
+				sum += pixels[y*n+x] * math.Cos(math.Pi/float64(n)*(float64(x)+0.5)*float64(u))
+			}
+			rows[y*hashSide+u] = sum
+		}
+	}
+	low := make([]float64, hashSide*hashSide)
+	for v := 0; v < hashSide; v++ {
+		for u := 0; u < hashSide; u++ {
+			sum := 0.0
+			for y := 0; y < n; y++ {
+				sum += rows[y*hashSide+u] * math.Cos(math.Pi/float64(n)*(float64(y)+0.5)*float64(v))
+			}
+			low[v*hashSide+u] = sum
+		}
+	}
+
+	sorted := append([]float64(nil), low...)
+	sort.Float64s(sorted)
+	median := (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+
+	return thresholdBits(low, median)
+}
+
+func thresholdBits(values []float64, threshold float64) uint64 {
+	var hash uint64
+	for _, value := range values {
+		hash <<= 1
+		if value > threshold {
+			hash |= 1
+		}
+	}
+
+	return hash
+}
@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+	"testing"
+)
+
+func hashTestPixels(width, height int, value func(x, y int) float64) []float64 {
+	pixels := make([]float64, 0, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			pixels = append(pixels, value(x, y))
+		}
+	}
+
+	return pixels
+}
+
+// hashTestPattern is an arbitrary grayscale image without symmetries
+func hashTestPattern(x, y int) float64 {
+	return float64((x*x*31 + y*17 + x*y*7) % 256)
+}
+
+func TestAverageHash(t *testing.T) {
+	tests := []struct {
+		name  string
+		value func(x, y int) float64
+		want  uint64
+	}{
+		{"right half bright", func(x, y int) float64 { return float64(x / 4 * 255) }, 0x0f0f0f0f0f0f0f0f},
+		{"bottom half bright", func(x, y int) float64 { return float64(y / 4 * 255) }, 0x00000000ffffffff},
+		{"uniform", func(x, y int) float64 { return 128 }, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := averageHash(hashTestPixels(hashSide, hashSide, tt.value))
+			if got != tt.want {
+				t.Errorf("averageHash() = %016x, want %016x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDifferenceHash(t *testing.T) {
+	tests := []struct {
+		name  string
+		value func(x, y int) float64
+		want  uint64
+	}{
+		{"brighter to the right", func(x, y int) float64 { return float64(x) }, 0xffffffffffffffff},
+		{"darker to the right", func(x, y int) float64 { return float64(-x) }, 0},
+		{"alternating rows", func(x, y int) float64 { return float64(x * (1 - y%2*2)) }, 0xff00ff00ff00ff00},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := differenceHash(hashTestPixels(hashSide+1, hashSide, tt.value))
+			if got != tt.want {
+				t.Errorf("differenceHash() = %016x, want %016x", got, tt.want)
+			}
+		})
+	}
+}
+
+// directPerceptualHash computes the low frequencies with the plain 2D DCT-II formula
+func directPerceptualHash(pixels []float64) uint64 {
+	n := perceptualHashSide
+	low := make([]float64, 0, hashSide*hashSide)
+	for v := 0; v < hashSide; v++ {
+		for u := 0; u < hashSide; u++ {
+			sum := 0.0
+			for y := 0; y < n; y++ {
+				for x := 0; x < n; x++ {
+					sum += pixels[y*n+x] * math.Cos(math.Pi*(2*float64(x)+1)*float64(u)/float64(2*n)) * math.Cos(math.Pi*(2*float64(y)+1)*float64(v)/float64(2*n))
+				}
+			}
+			low = append(low, sum)
+		}
+	}
+	sorted := append([]float64(nil), low...)
+	sort.Float64s(sorted)
+	median := (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+
+	return thresholdBits(low, median)
+}
+
+func TestPerceptualHash(t *testing.T) {
+	n := perceptualHashSide
+	pattern := hashTestPixels(n, n, hashTestPattern)
+	got := perceptualHash(pattern)
+	if want := directPerceptualHash(pattern); got != want {
+		t.Errorf("perceptualHash() = %016x, direct DCT gives %016x", got, want)
+	}
+	if ones := bits.OnesCount64(got); ones < 28 || ones > 36 {
+		t.Errorf("perceptualHash() = %016x has %d bits set, the median splits about half", got, ones)
+	}
+
+	// contrast changes scale every frequency alike
+	scaled := hashTestPixels(n, n, func(x, y int) float64 { return hashTestPattern(x, y) * 0.5 })
+	if scaledHash := perceptualHash(scaled); scaledHash != got {
+		t.Errorf("perceptualHash() of scaled image = %016x, want %016x", scaledHash, got)
+	}
+
+	// a mirrored image flips the sign of odd horizontal frequencies
+	mirrored := hashTestPixels(n, n, func(x, y int) float64 { return hashTestPattern(n-1-x, y) })
+	if distance := bits.OnesCount64(perceptualHash(mirrored) ^ got); distance < 10 {
+		t.Errorf("perceptualHash() of mirrored image is %d bits apart, want a different hash", distance)
+	}
+}
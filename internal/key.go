@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/nocturnecity/image-resizer/pkg"
+)
+
+// content-addressed keys never change their content
+const ImmutableCacheControl = "public, max-age=31536000, immutable"
+
+// outputKey renders the key of a size, {size_name}.{format} under PathToSave by default
+func (rh *ResizeHandler) outputKey(size pkg.Size, format, filename string, width int) (string, error) {
+	template := rh.Request.KeyTemplate
+	if template == "" {
+		return fmt.Sprintf("%s/%s.%s", rh.Request.PathToSave, size.SizeName, format), nil
+	}
+
+	basename := path.Base(rh.Request.OriginalPath)
+	replacements := []string{
+		pkg.KeySize, size.SizeName,
+		pkg.KeyWidth, strconv.Itoa(width),
+		pkg.KeyFormat, format,
+		pkg.KeyOriginalBasename, strings.TrimSuffix(basename, path.Ext(basename)),
+	}
+	if pkg.IsContentAddressed(template) {
+		hash, err := fileHash(filename)
+		if err != nil {
+			return "", err
+		}
+		replacements = append(replacements, pkg.KeyHash, hash)
+	}
+
+	return fmt.Sprintf("%s/%s", rh.Request.PathToSave, strings.NewReplacer(replacements...).Replace(template)), nil
+}
+
+func fileHash(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file %q, %v", filename, err)
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("failed to hash file %q, %v", filename, err)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// objectExists checks the key without downloading it
+func (rh *ResizeHandler) objectExists(bucketName, key, region string) (bool, error) {
+	head, err := rh.headObject(bucketName, key, region)
+	if err != nil {
+		return false, err
+	}
+
+	return head != nil, nil
+}
+
+// headObject returns nil for missing keys
+func (rh *ResizeHandler) headObject(bucketName, key, region string) (*s3.HeadObjectOutput, error) {
+	var err error
+	if rh.session == nil {
+		rh.session, err = session.NewSession(&aws.Config{
+			Region: aws.String(region),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create session: %w", err)
+		}
+	}
+	var head *s3.HeadObjectOutput
+	err = rh.withRetry("head", func() error {
+		var err error
+		head, err = s3.New(rh.session).HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(bucketName),
+			Key:    aws.String(key),
+		})
+		return err
+	})
+	var requestFailure awserr.RequestFailure
+	if errors.As(err, &requestFailure) && requestFailure.StatusCode() == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to head object %q, %v", key, err)
+	}
+
+	return head, nil
+}
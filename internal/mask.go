@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"fmt"
+	"os/exec"
+	"time"
+
+	"github.com/nocturnecity/image-resizer/pkg"
+)
+
+const DefaultAlphaFormat = "png"
+
+// output formats able to keep the transparency left by a mask
+var alphaFormats = map[string]bool{
+	"png":  true,
+	"webp": true,
+	"gif":  true,
+	"avif": true,
+	"heic": true,
+	"jxl":  true,
+	"tiff": true,
+}
+
+// maskFormat switches the output to a format with transparency when the
+// mask would otherwise be flattened onto an arbitrary color
+func maskFormat(format string, opt *pkg.MaskOptions) string {
+	if opt == nil || opt.Background != "" || alphaFormats[format] {
+		return format
+	}
+
+	return DefaultAlphaFormat
+}
+
+func (rh *ResizeHandler) maskCommand(filename, result string, animated bool, opt *pkg.MaskOptions) error {
+	start := time.Now()
+	info, err := rh.getResultFileInfo(posterFrame(filename), "")
+	if err != nil {
+		return fmt.Errorf("error mask file %w", err)
+	}
+	maskArgs, err := rh.maskArgs(opt, info.Width, info.Height)
+	if err != nil {
+		return fmt.Errorf("error mask file %w", err)
+	}
+
+	args := []string{
+		"-limit",
+		"memory",
+		rh.memoryLimit,
+		"-limit",
+		"time",
+		rh.timeout,
+		filename,
+	}
+	// the mask alpha is kept where both the image and the mask are opaque
+	if animated {
+		args = append(args, "-coalesce", "null:")
+		args = append(args, maskArgs...)
+		args = append(args, "-compose", "DstIn", "-layers", "composite")
+	} else {
+		args = append(args, "-alpha", "set")
+		args = append(args, maskArgs...)
+		args = append(args, "-compose", "DstIn", "-composite")
+	}
+	if opt.Background != "" {
+		args = append(args, "-background", opt.Background, "-alpha", "remove", "-alpha", "off")
+	}
+	if animated {
+		args = append(args, "-layers", "Optimize")
+	}
+	args = append(args, result)
+
+	cmd := exec.Command("magick", args...)
+	res, err := cmd.CombinedOutput()
+	durationMs := float64(time.Since(start).Milliseconds())
+	rh.log.Debug("%s: duration: %.2f", cmd.String(), durationMs)
+	if string(res) != "" {
+		rh.log.Debug(string(res))
+	}
+	if err != nil {
+		return fmt.Errorf("error mask file %w, command output: %s", err, res)
+	}
+
+	return nil
+}
+
+// maskArgs builds the mask as a parenthesized image of the given size,
+// opaque where the result should stay visible
+func (rh *ResizeHandler) maskArgs(opt *pkg.MaskOptions, width, height int) ([]string, error) {
+	canvas := []string{
+		"(",
+		"-size",
+		fmt.Sprintf("%dx%d", width, height),
+		"xc:none",
+		"-fill",
+		"white",
+		"-draw",
+	}
+	switch opt.Type {
+	case pkg.MaskCircle:
+		radius := float64(min(width, height)) / 2
+		cx, cy := float64(width)/2, float64(height)/2
+		return append(canvas,
+			fmt.Sprintf("circle %s,%s %s,%s", formatFloat(cx), formatFloat(cy), formatFloat(cx), formatFloat(cy-radius)),
+			")",
+		), nil
+	case pkg.MaskRoundedRect:
+		return append(canvas,
+			fmt.Sprintf("roundrectangle 0,0 %d,%d %d,%d", width-1, height-1, opt.Radius, opt.Radius),
+			")",
+		), nil
+	case pkg.MaskImage:
+		maskPath, _, err := rh.watermarkProvider.GetWatermark(opt.ImageURL)
+		if err != nil {
+			return nil, err
+		}
+		return []string{
+			"(",
+			maskPath,
+			"-resize",
+			fmt.Sprintf("%dx%d!", width, height),
+			"-colorspace",
+			"Gray",
+			"-alpha",
+			"copy",
+			")",
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown mask type %q", opt.Type)
+}
@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"fmt"
+	"os/exec"
+	"time"
+
+	"github.com/nocturnecity/image-resizer/pkg"
+)
+
+// needsMetadata tells whether prepared originals get tags back after -strip
+func needsMetadata(opt *pkg.MetadataOptions) bool {
+	return opt != nil && (len(opt.KeptTags()) > 0 || opt.Copyright != "" || opt.Artist != "")
+}
+
+// metadataCommand writes the kept tags of the source and the injected ones
+// into the prepared original, later ImageMagick steps carry them to sizes.
+// Orientation isn't kept, prepared originals are already auto-oriented.
+func (rh *ResizeHandler) metadataCommand(source, prepared string, opt *pkg.MetadataOptions) error {
+	start := time.Now()
+	args := []string{
+		"-quiet",
+		"-overwrite_original",
+		// leave only the ICC profile the preparation has attached
+		"-all=",
+		"-TagsFromFile",
+		"@",
+		"-ICC_Profile",
+	}
+	if tags := opt.KeptTags(); len(tags) > 0 {
+		args = append(args, "-TagsFromFile", source)
+		for _, tag := range tags {
+			args = append(args, "-"+tag)
+		}
+	}
+	if opt.Copyright != "" {
+		args = append(args, "-Copyright="+opt.Copyright, "-XMP-dc:Rights="+opt.Copyright)
+	}
+	if opt.Artist != "" {
+		args = append(args, "-Artist="+opt.Artist, "-XMP-dc:Creator="+opt.Artist)
+	}
+	args = append(args, prepared)
+
+	cmd := exec.Command("exiftool", args...)
+	res, err := cmd.CombinedOutput()
+	durationMs := float64(time.Since(start).Milliseconds())
+	rh.log.Debug("%s: duration: %.2f", cmd.String(), durationMs)
+	if string(res) != "" {
+		rh.log.Debug(string(res))
+	}
+	if err != nil {
+		return fmt.Errorf("error write metadata %w, command output: %s", err, res)
+	}
+
+	return nil
+}
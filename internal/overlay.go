@@ -0,0 +1,264 @@
+package internal
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/nocturnecity/image-resizer/pkg"
+)
+
+const DefaultFontDir = "/usr/share/fonts/truetype/dejavu"
+const DefaultFont = "DejaVuSans.ttf"
+const DefaultTextSizeRatio = 0.05
+const DefaultTextColor = "white"
+const DefaultTextStrokeColor = "black"
+const DefaultWatermarkGravity = "northwest"
+const DefaultWatermarkBlendMode = "over"
+const DefaultTextShadow = "60x3+3+3"
+
+// waterMarkCommand composes all watermark layers in order in one invocation
+func (rh *ResizeHandler) waterMarkCommand(filename, result string, animated bool, watermarks []pkg.WaterMarkOptions) error {
+	start := time.Now()
+	info, err := rh.getResultFileInfo(posterFrame(filename), "")
+	if err != nil {
+		return fmt.Errorf("error add watermark to file %w", err)
+	}
+	var layers []string
+	for i := range watermarks {
+		layer, err := rh.watermarkLayerArgs(&watermarks[i], i, animated, info.Width, info.Height)
+		if err != nil {
+			return fmt.Errorf("error add watermark to file %w", err)
+		}
+		layers = append(layers, layer...)
+	}
+
+	args := []string{
+		"-limit",
+		"memory",
+		rh.memoryLimit,
+		"-limit",
+		"time",
+		rh.timeout,
+		filename,
+	}
+	if animated {
+		args = append(args, "-coalesce")
+	}
+	args = append(args, layers...)
+	if animated {
+		args = append(args, "-layers", "Optimize")
+	}
+	args = append(args, result)
+
+	cmd := exec.Command("magick", args...)
+	res, err := cmd.CombinedOutput()
+	durationMs := float64(time.Since(start).Milliseconds())
+	rh.log.Debug("%s: duration: %.2f", cmd.String(), durationMs)
+	if string(res) != "" {
+		rh.log.Debug(string(res))
+	}
+	if err != nil {
+		return fmt.Errorf("error add watermark to file %w, command output: %s", err, res)
+	}
+
+	return nil
+}
+
+// watermarkLayerArgs renders the watermark and composes it over the current
+// image of the given size, animated images are expected to be coalesced
+func (rh *ResizeHandler) watermarkLayerArgs(opt *pkg.WaterMarkOptions, index int, animated bool, width, height int) ([]string, error) {
+	var content []string
+	var err error
+	if opt.Text != nil {
+		content, err = rh.textContentArgs(opt.Text, width)
+	} else {
+		content, err = rh.imageContentArgs(opt, width)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// settings are global in ImageMagick and leak out of parentheses, a tile
+	// after a stroked text would otherwise get bordered with the text stroke
+	layer := append(layerResetArgs(), "(")
+	layer = append(layer, content...)
+	layer = append(layer, layerStyleArgs(opt)...)
+	blendMode := opt.BlendMode
+	if blendMode == "" {
+		blendMode = DefaultWatermarkBlendMode
+	}
+	if !opt.Tile {
+		layer = append(layer, ")")
+		return compositeArgs(animated, layer, placementArgs(opt, width, height), blendMode), nil
+	}
+
+	// the styled watermark with transparent spacing around becomes a pattern
+	// kept in memory while the command runs and tiled over the image
+	register := fmt.Sprintf("mpr:watermark%d", index)
+	if opt.TileSpacing > 0 {
+		layer = append(layer, "-bordercolor", "none", "-border", fmt.Sprintf("%d", (opt.TileSpacing+1)/2))
+	}
+	layer = append(layer, "-write", register, "+delete", ")")
+	tiles := []string{
+		"(",
+		"-size",
+		fmt.Sprintf("%dx%d", width, height),
+		"tile:" + register,
+		")",
+	}
+	placement := []string{
+		"-gravity",
+		"northwest",
+		"-geometry",
+		"+0+0",
+	}
+
+	return append(layer, compositeArgs(animated, tiles, placement, blendMode)...), nil
+}
+
+func (rh *ResizeHandler) imageContentArgs(opt *pkg.WaterMarkOptions, imageWidth int) ([]string, error) {
+	watermarkPath, _, err := rh.watermarkProvider.GetWatermark(opt.WatermarkImageURL)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{watermarkPath}
+	if opt.WidthRatio > 0 {
+		args = append(args, "-resize", fmt.Sprintf("%d", max(1, int(math.Round(opt.WidthRatio*float64(imageWidth))))))
+	} else if opt.Width > 0 || opt.Height > 0 {
+		args = append(args, "-resize", fmt.Sprintf("%dx%d", opt.Width, opt.Height))
+	}
+
+	return args, nil
+}
+
+// textContentArgs renders the text as a transparent image
+func (rh *ResizeHandler) textContentArgs(text *pkg.TextWatermarkOptions, imageWidth int) ([]string, error) {
+	font, err := rh.resolveFont(text.Font)
+	if err != nil {
+		return nil, err
+	}
+	sizeRatio := orDefault(text.SizeRatio, DefaultTextSizeRatio)
+	color := text.Color
+	if color == "" {
+		color = DefaultTextColor
+	}
+
+	args := []string{
+		"-background",
+		"none",
+		"-font",
+		font,
+		"-pointsize",
+		formatFloat(max(1, sizeRatio*float64(imageWidth))),
+		"-fill",
+		color,
+	}
+	if text.StrokeWidth > 0 {
+		strokeColor := text.StrokeColor
+		if strokeColor == "" {
+			strokeColor = DefaultTextStrokeColor
+		}
+		args = append(args, "-stroke", strokeColor, "-strokewidth", formatFloat(text.StrokeWidth))
+	}
+	args = append(args, "label:"+escapeMagickText(text.Text))
+	if text.Shadow {
+		args = append(args,
+			"(", "+clone", "-background", "black", "-shadow", DefaultTextShadow, ")",
+			"+swap", "-background", "none", "-layers", "merge", "+repage",
+		)
+	}
+
+	return args, nil
+}
+
+// layerResetArgs restores the drawing settings earlier layers may have changed
+func layerResetArgs() []string {
+	return []string{
+		"+stroke",
+		"-strokewidth",
+		"1",
+		"-fill",
+		"black",
+		"-compose",
+		"over",
+		"-gravity",
+		DefaultWatermarkGravity,
+	}
+}
+
+// layerStyleArgs rotates the layer and applies its opacity
+func layerStyleArgs(opt *pkg.WaterMarkOptions) []string {
+	var args []string
+	if opt.Rotation != 0 {
+		args = append(args, "-background", "none", "-rotate", formatFloat(opt.Rotation), "+repage")
+	}
+	if opt.Opacity > 0 && opt.Opacity < 1 {
+		args = append(args, "-alpha", "set", "-channel", "A", "-evaluate", "multiply", formatFloat(opt.Opacity), "+channel")
+	}
+
+	return args
+}
+
+func placementArgs(opt *pkg.WaterMarkOptions, width, height int) []string {
+	gravity := opt.Gravity
+	if gravity == "" {
+		gravity = DefaultWatermarkGravity
+	}
+	x := opt.X + int(math.Round(opt.XPercent*float64(width)/100))
+	y := opt.Y + int(math.Round(opt.YPercent*float64(height)/100))
+
+	return []string{
+		"-gravity",
+		gravity,
+		"-geometry",
+		fmt.Sprintf("%+d%+d", x, y),
+	}
+}
+
+// compositeArgs puts a layer over the current image, animated images are
+// expected to be coalesced and get the layer on every frame
+func compositeArgs(animated bool, layer, placement []string, blendMode string) []string {
+	var args []string
+	if animated {
+		args = append(args, "null:")
+	}
+	args = append(args, layer...)
+	args = append(args, placement...)
+	args = append(args, "-compose", blendMode)
+	if animated {
+		return append(args, "-layers", "composite")
+	}
+
+	return append(args, "-composite")
+}
+
+// resolveFont looks the font up in the configured directory only
+func (rh *ResizeHandler) resolveFont(name string) (string, error) {
+	if name == "" {
+		name = DefaultFont
+	}
+	path := filepath.Join(rh.fontDir, filepath.Base(name))
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("%w: font %q is not available", ErrInvalidInput, name)
+	}
+
+	return path, nil
+}
+
+// escapeMagickText keeps the text literal: ImageMagick expands percent
+// escapes and reads the text from a file when it starts with @
+func escapeMagickText(text string) string {
+	text = strings.ReplaceAll(text, `\`, `\\`)
+	text = strings.ReplaceAll(text, "%", "%%")
+	if strings.HasPrefix(text, "@") {
+		text = `\` + text
+	}
+
+	return text
+}
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/nocturnecity/image-resizer/pkg"
+)
+
+const DefaultPaletteColors = 5
+
+// quantization doesn't need more pixels than that
+const DefaultPaletteSide = 200
+
+// histogram line: "  1234: (255,0,0) #FF0000 srgb(255,0,0)"
+var histogramLinePattern = regexp.MustCompile(`^\s*(\d+):\s*\([^)]*\)\s*(#[0-9A-Fa-f]{6})`)
+
+// getPalette quantizes the first frame of the prepared original into the
+// requested number of colors, transparent areas count as white
+func (rh *ResizeHandler) getPalette(filename string, opt *pkg.PaletteOptions) ([]pkg.PaletteColor, error) {
+	start := time.Now()
+	colors := DefaultPaletteColors
+	if opt.Colors > 0 {
+		colors = int(opt.Colors)
+	}
+	cmd := exec.Command(
+		"magick",
+		"-limit",
+		"memory",
+		rh.memoryLimit,
+		"-limit",
+		"time",
+		rh.timeout,
+		posterFrame(filename),
+		"-resize",
+		fmt.Sprintf("%dx%d>", DefaultPaletteSide, DefaultPaletteSide),
+		"-colorspace",
+		"sRGB",
+		"-background",
+		"white",
+		"-flatten",
+		"-alpha",
+		"off",
+		"+dither",
+		"-colors",
+		strconv.Itoa(colors),
+		"-depth",
+		"8",
+		"-format",
+		"%c",
+		"histogram:info:-")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	res, err := cmd.Output()
+	durationMs := float64(time.Since(start).Milliseconds())
+	rh.log.Debug("%s: duration: %.2f", cmd.String(), durationMs)
+	if err != nil {
+		return nil, fmt.Errorf("error extract palette %w, command output: %s", err, stderr.String())
+	}
+
+	var palette []pkg.PaletteColor
+	var total int
+	counts := map[string]int{}
+	scanner := bufio.NewScanner(bytes.NewReader(res))
+	for scanner.Scan() {
+		match := histogramLinePattern.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			continue
+		}
+		count, _ := strconv.Atoi(match[1])
+		if counts[match[2]] == 0 {
+			palette = append(palette, pkg.PaletteColor{Color: match[2]})
+		}
+		counts[match[2]] += count
+		total += count
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("error extract palette: empty histogram")
+	}
+	for i := range palette {
+		palette[i].Weight = float64(counts[palette[i].Color]) / float64(total)
+	}
+	sort.SliceStable(palette, func(i, j int) bool {
+		return palette[i].Weight > palette[j].Weight
+	})
+
+	return palette, nil
+}
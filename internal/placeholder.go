@@ -0,0 +1,319 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"math"
+	"os/exec"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/nocturnecity/image-resizer/pkg"
+)
+
+// thumbhash is defined for images up to 100x100
+const DefaultPlaceholderSide = 100
+const DefaultBlurHashComponentsX = 4
+const DefaultBlurHashComponentsY = 3
+const DefaultLQIPSide = 20
+const DefaultLQIPQuality = 40
+
+const blurHashCharacters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// generatePlaceholders computes the requested placeholders from the first
+// frame of the prepared original
+func (rh *ResizeHandler) generatePlaceholders(filename string) (*pkg.Placeholders, error) {
+	placeholders := &pkg.Placeholders{}
+	requested := rh.Request.Placeholders
+	if slices.Contains(requested, pkg.PlaceholderBlurHash) || slices.Contains(requested, pkg.PlaceholderThumbHash) {
+		res, err := rh.placeholderCommand(filename, "-resize", fmt.Sprintf("%dx%d>", DefaultPlaceholderSide, DefaultPlaceholderSide), "PNG32:-")
+		if err != nil {
+			return nil, err
+		}
+		decoded, err := png.Decode(bytes.NewReader(res))
+		if err != nil {
+			return nil, fmt.Errorf("error decode placeholder image %w", err)
+		}
+		img := image.NewNRGBA(decoded.Bounds())
+		draw.Draw(img, img.Bounds(), decoded, decoded.Bounds().Min, draw.Src)
+		if slices.Contains(requested, pkg.PlaceholderBlurHash) {
+			placeholders.BlurHash = encodeBlurHash(img, DefaultBlurHashComponentsX, DefaultBlurHashComponentsY)
+		}
+		if slices.Contains(requested, pkg.PlaceholderThumbHash) {
+			placeholders.ThumbHash = base64.StdEncoding.EncodeToString(encodeThumbHash(img))
+		}
+	}
+	if slices.Contains(requested, pkg.PlaceholderLQIP) {
+		res, err := rh.placeholderCommand(filename,
+			"-resize",
+			fmt.Sprintf("%dx%d>", DefaultLQIPSide, DefaultLQIPSide),
+			"-background",
+			"white",
+			"-flatten",
+			"-strip",
+			"-quality",
+			strconv.Itoa(DefaultLQIPQuality),
+			"jpeg:-",
+		)
+		if err != nil {
+			return nil, err
+		}
+		placeholders.LQIP = "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(res)
+	}
+
+	return placeholders, nil
+}
+
+// placeholderCommand renders the poster frame into stdout
+func (rh *ResizeHandler) placeholderCommand(filename string, ops ...string) ([]byte, error) {
+	start := time.Now()
+	args := []string{
+		"-limit",
+		"memory",
+		rh.memoryLimit,
+		"-limit",
+		"time",
+		rh.timeout,
+		posterFrame(filename),
+		"-colorspace",
+		"sRGB",
+	}
+	args = append(args, ops...)
+
+	cmd := exec.Command("magick", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	res, err := cmd.Output()
+	durationMs := float64(time.Since(start).Milliseconds())
+	rh.log.Debug("%s: duration: %.2f", cmd.String(), durationMs)
+	if err != nil {
+		return nil, fmt.Errorf("error render placeholder %w, command output: %s", err, stderr.String())
+	}
+
+	return res, nil
+}
+
+// encodeBlurHash implements https://github.com/woltapp/blurhash, alpha is ignored
+func encodeBlurHash(img *image.NRGBA, componentsX, componentsY int) string {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	factors := make([][3]float64, 0, componentsX*componentsY)
+	for y := 0; y < componentsY; y++ {
+		for x := 0; x < componentsX; x++ {
+			normalisation := 2.0
+			if x == 0 && y == 0 {
+				normalisation = 1
+			}
+			var factor [3]float64
+			for j := 0; j < height; j++ {
+				for i := 0; i < width; i++ {
+					basis := math.Cos(math.Pi*float64(x*i)/float64(width)) * math.Cos(math.Pi*float64(y*j)/float64(height))
+					offset := j*img.Stride + i*4
+					for c := 0; c < 3; c++ {
+						factor[c] += basis * srgbToLinear(img.Pix[offset+c])
+					}
+				}
+			}
+			scale := normalisation / float64(width*height)
+			for c := 0; c < 3; c++ {
+				factor[c] *= scale
+			}
+			factors = append(factors, factor)
+		}
+	}
+
+	hash := encodeBase83((componentsX-1)+(componentsY-1)*9, 1)
+	maximumValue := 1.0
+	if len(factors) > 1 {
+		actualMaximum := 0.0
+		for _, factor := range factors[1:] {
+			for c := 0; c < 3; c++ {
+				actualMaximum = math.Max(actualMaximum, math.Abs(factor[c]))
+			}
+		}
+		quantisedMaximum := int(math.Max(0, math.Min(82, math.Floor(actualMaximum*166-0.5))))
+		maximumValue = float64(quantisedMaximum+1) / 166
+		hash += encodeBase83(quantisedMaximum, 1)
+	} else {
+		hash += encodeBase83(0, 1)
+	}
+
+	dc := factors[0]
+	hash += encodeBase83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4)
+	for _, factor := range factors[1:] {
+		value := 0
+		for c := 0; c < 3; c++ {
+			quantised := int(math.Max(0, math.Min(18, math.Floor(signPow(factor[c]/maximumValue, 0.5)*9+9.5))))
+			value = value*19 + quantised
+		}
+		hash += encodeBase83(value, 2)
+	}
+
+	return hash
+}
+
+func encodeBase83(value, length int) string {
+	result := make([]byte, length)
+	for i := 1; i <= length; i++ {
+		digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+		result[i-1] = blurHashCharacters[digit]
+	}
+
+	return string(result)
+}
+
+func srgbToLinear(value uint8) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
+
+// encodeThumbHash implements https://github.com/evanw/thumbhash for images
+// up to 100x100
+func encodeThumbHash(img *image.NRGBA) []byte {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	pixels := width * height
+	// arithmetic follows the reference operation by operation, AC terms near
+	// zero round differently otherwise
+	pixel := func(i, c int) float64 {
+		return float64(img.Pix[(i/width)*img.Stride+(i%width)*4+c])
+	}
+
+	// average color, weighted by alpha
+	var avgR, avgG, avgB, avgA float64
+	for i := 0; i < pixels; i++ {
+		alpha := pixel(i, 3) / 255
+		avgR += alpha / 255 * pixel(i, 0)
+		avgG += alpha / 255 * pixel(i, 1)
+		avgB += alpha / 255 * pixel(i, 2)
+		avgA += alpha
+	}
+	if avgA > 0 {
+		avgR /= avgA
+		avgG /= avgA
+		avgB /= avgA
+	}
+
+	hasAlpha := avgA < float64(pixels)
+	// fewer luminance components leave room for alpha
+	limit := 7.0
+	if hasAlpha {
+		limit = 5
+	}
+	longest := float64(max(width, height))
+	lx := max(1, int(jsRound(limit*float64(width)/longest)))
+	ly := max(1, int(jsRound(limit*float64(height)/longest)))
+
+	// composite atop the average color and convert into LPQA
+	l := make([]float64, pixels)
+	p := make([]float64, pixels)
+	q := make([]float64, pixels)
+	a := make([]float64, pixels)
+	for i := 0; i < pixels; i++ {
+		alpha := pixel(i, 3) / 255
+		r := avgR*(1-alpha) + alpha/255*pixel(i, 0)
+		g := avgG*(1-alpha) + alpha/255*pixel(i, 1)
+		b := avgB*(1-alpha) + alpha/255*pixel(i, 2)
+		l[i] = (r + g + b) / 3
+		p[i] = (r+g)/2 - b
+		q[i] = r - g
+		a[i] = alpha
+	}
+
+	lDC, lAC, lScale := encodeThumbHashChannel(l, width, height, max(3, lx), max(3, ly))
+	pDC, pAC, pScale := encodeThumbHashChannel(p, width, height, 3, 3)
+	qDC, qAC, qScale := encodeThumbHashChannel(q, width, height, 3, 3)
+
+	isLandscape := width > height
+	header24 := int(jsRound(63*lDC)) | int(jsRound(31.5+31.5*pDC))<<6 | int(jsRound(31.5+31.5*qDC))<<12 | int(jsRound(31*lScale))<<18
+	if hasAlpha {
+		header24 |= 1 << 23
+	}
+	header16 := int(jsRound(63*pScale))<<3 | int(jsRound(63*qScale))<<9
+	if isLandscape {
+		header16 |= ly | 1<<15
+	} else {
+		header16 |= lx
+	}
+	hash := []byte{byte(header24), byte(header24 >> 8), byte(header24 >> 16), byte(header16), byte(header16 >> 8)}
+	channels := [][]float64{lAC, pAC, qAC}
+	if hasAlpha {
+		aDC, aAC, aScale := encodeThumbHashChannel(a, width, height, 5, 5)
+		hash = append(hash, byte(int(jsRound(15*aDC))|int(jsRound(15*aScale))<<4))
+		channels = append(channels, aAC)
+	}
+
+	// two factors per byte, low nibble first
+	index := 0
+	for _, ac := range channels {
+		for _, f := range ac {
+			if index%2 == 0 {
+				hash = append(hash, 0)
+			}
+			hash[len(hash)-1] |= byte(int(jsRound(15*f)) << ((index & 1) << 2))
+			index++
+		}
+	}
+
+	return hash
+}
+
+// encodeThumbHashChannel returns the DC term, AC terms normalized into 0..1 and their scale
+func encodeThumbHashChannel(channel []float64, width, height, nx, ny int) (float64, []float64, float64) {
+	var dc, scale float64
+	var ac []float64
+	fx := make([]float64, width)
+	for cy := 0; cy < ny; cy++ {
+		for cx := 0; cx*ny < nx*(ny-cy); cx++ {
+			for x := 0; x < width; x++ {
+				fx[x] = math.Cos(math.Pi / float64(width) * float64(cx) * (float64(x) + 0.5))
+			}
+			f := 0.0
+			for y := 0; y < height; y++ {
+				fy := math.Cos(math.Pi / float64(height) * float64(cy) * (float64(y) + 0.5))
+				for x := 0; x < width; x++ {
+					f += channel[x+y*width] * fx[x] * fy
+				}
+			}
+			f /= float64(width * height)
+			if cx > 0 || cy > 0 {
+				ac = append(ac, f)
+				scale = math.Max(scale, math.Abs(f))
+			} else {
+				dc = f
+			}
+		}
+	}
+	if scale > 0 {
+		for i := range ac {
+			ac[i] = 0.5 + 0.5/scale*ac[i]
+		}
+	}
+
+	return dc, ac, scale
+}
+
+// jsRound rounds halves up like the reference implementation does
+func jsRound(value float64) float64 {
+	return math.Floor(value + 0.5)
+}
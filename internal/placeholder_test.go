@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"encoding/base64"
+	"image"
+	"testing"
+)
+
+// placeholderTestImages are drawn the same way as the images the reference
+// implementations were run on to get the expected hashes
+var placeholderTestImages = map[string]struct {
+	width, height int
+	color         func(x, y int) [4]uint8
+}{
+	"solid": {4, 3, func(x, y int) [4]uint8 {
+		return [4]uint8{255, 255, 255, 255}
+	}},
+	"gradient": {32, 24, func(x, y int) [4]uint8 {
+		return [4]uint8{uint8(x * 8), uint8(y * 10), uint8((x + y) * 4), 255}
+	}},
+	"portrait": {12, 30, func(x, y int) [4]uint8 {
+		return [4]uint8{uint8(x * y % 256), uint8(200 - y*5), uint8(x * 20), 255}
+	}},
+	"alpha": {20, 20, func(x, y int) [4]uint8 {
+		return [4]uint8{uint8(x * 12), 100, uint8(y * 12), uint8((x + y) * 6)}
+	}},
+	"pattern": {16, 10, func(x, y int) [4]uint8 {
+		return [4]uint8{uint8((x*x*31 + y*17) % 256), uint8((x*y*7 + y*y*13) % 256), uint8((x*53 + y*y*y) % 256), 255}
+	}},
+	"pattern_alpha": {9, 14, func(x, y int) [4]uint8 {
+		return [4]uint8{uint8((x*x*31 + y*17) % 256), uint8((x*y*7 + y*y*13) % 256), uint8((x*53 + y*y*y) % 256), uint8((x*41 + y*y*11) % 256)}
+	}},
+}
+
+func placeholderTestImage(t *testing.T, name string) *image.NRGBA {
+	t.Helper()
+	spec, ok := placeholderTestImages[name]
+	if !ok {
+		t.Fatalf("unknown test image %q", name)
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, spec.width, spec.height))
+	for y := 0; y < spec.height; y++ {
+		for x := 0; x < spec.width; x++ {
+			color := spec.color(x, y)
+			copy(img.Pix[y*img.Stride+x*4:], color[:])
+		}
+	}
+
+	return img
+}
+
+func TestEncodeBlurHash(t *testing.T) {
+	// expected hashes come from a line-by-line port of the woltapp/blurhash C encoder
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{"solid", "L~TSUA~qfQ~q~q%MfQ%MfQfQfQfQ"},
+		{"gradient", "LxH27b2kwzX5mAWYjuf7gKfkfQfj"},
+		{"portrait", "LiB#YOG2SPxtH6xCsVSzXisnSMsn"},
+		{"alpha", "LnF#2|2twxbcsxWnjtfOfUfRfQfR"},
+		{"pattern", "LHGl0TG8W8-,vqEMEe#nl@mnFdIo"},
+		{"pattern_alpha", "LGG+E;^kn3?*0%6Iv}F,zFIv$LEN"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			got := encodeBlurHash(placeholderTestImage(t, tt.image), DefaultBlurHashComponentsX, DefaultBlurHashComponentsY)
+			if got != tt.want {
+				t.Errorf("encodeBlurHash() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeThumbHash(t *testing.T) {
+	// expected hashes come from a line-by-line port of rgbaToThumbHash of
+	// evanw/thumbhash; images symmetric enough to have AC terms of exactly
+	// zero are left out, those terms are rounding noise which differs between
+	// cos implementations
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{"portrait", "mZcNSxxwiHh4eId4f4hHB3k="},
+		{"pattern", "nRcGFIpyRxhAlVdSVpX4IEO59g=="},
+		{"pattern_alpha", "HgiGEwQXiXBrOGaLkJM29QawVcd1cFg="},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			got := base64.StdEncoding.EncodeToString(encodeThumbHash(placeholderTestImage(t, tt.image)))
+			if got != tt.want {
+				t.Errorf("encodeThumbHash() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJsRound(t *testing.T) {
+	tests := []struct {
+		value float64
+		want  float64
+	}{
+		{0.5, 1},
+		{1.5, 2},
+		{2.5, 3},
+		{-0.5, 0},
+		{-1.5, -1},
+		{0.49, 0},
+	}
+	for _, tt := range tests {
+		if got := jsRound(tt.value); got != tt.want {
+			t.Errorf("jsRound(%v) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
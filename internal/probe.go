@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nocturnecity/image-resizer/pkg"
+)
+
+// probeExifFields are reported by probe, GPS ones are left out on purpose
+var probeExifFields = map[string]bool{
+	"Make":                    true,
+	"Model":                   true,
+	"LensModel":               true,
+	"Software":                true,
+	"DateTimeOriginal":        true,
+	"ExposureTime":            true,
+	"FNumber":                 true,
+	"PhotographicSensitivity": true,
+	"FocalLength":             true,
+	"Artist":                  true,
+	"Copyright":               true,
+}
+
+// orientations which swap width and height when applied
+var transposingOrientations = map[string]bool{
+	"LeftTop":     true,
+	"RightTop":    true,
+	"RightBottom": true,
+	"LeftBottom":  true,
+}
+
+// Probe describes the original without processing it, the limits of
+// resizes apply to it as well
+func (rh *ResizeHandler) Probe(filename string) (*pkg.ProbeResponse, error) {
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error probe file %w", err)
+	}
+	response := &pkg.ProbeResponse{
+		FileSize: stat.Size(),
+		Frames:   1,
+	}
+	if documentFormats[rh.Request.Format] {
+		response.Pages, err = rh.getPageCount(filename)
+		if err != nil {
+			return nil, fmt.Errorf("error probe file %w", err)
+		}
+		if response.Pages > rh.maxPages {
+			return nil, fmt.Errorf("%w: %d pages exceed limit of %d", ErrInvalidInput, response.Pages, rh.maxPages)
+		}
+	}
+	if animatedFormats[rh.Request.Format] {
+		animation, err := rh.getAnimationInfo(filename)
+		if err != nil {
+			return nil, fmt.Errorf("error probe file %w", err)
+		}
+		err = rh.checkAnimationLimits(animation)
+		if err != nil {
+			return nil, err
+		}
+		response.Frames = animation.frames
+	}
+	input, err := rh.inspectedInput(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	err = rh.identifyProbe(posterFrame(input), response)
+	if err != nil {
+		return nil, err
+	}
+	response.Exif, err = rh.getExifFields(posterFrame(input))
+	if err != nil {
+		return nil, err
+	}
+
+	return response, nil
+}
+
+func (rh *ResizeHandler) identifyProbe(filename string, response *pkg.ProbeResponse) error {
+	start := time.Now()
+	cmd := exec.Command(
+		"identify",
+		"-limit",
+		"memory",
+		rh.memoryLimit,
+		"-limit",
+		"time",
+		rh.timeout,
+		"-quiet",
+		"-format",
+		"%m\n%w\n%h\n%[orientation]\n%[colorspace]\n%z\n%A\n%[profiles]\n",
+		filename)
+	res, err := cmd.Output()
+	durationMs := float64(time.Since(start).Milliseconds())
+	rh.log.Debug("%s: duration: %.2f", cmd.String(), durationMs)
+	if err != nil {
+		return fmt.Errorf("%w: error identify file %v", ErrInvalidInput, err)
+	}
+
+	lines := strings.Split(string(res), "\n")
+	if len(lines) < 8 {
+		return fmt.Errorf("error identify file: unexpected output %q", res)
+	}
+	response.Format = strings.ToLower(lines[0])
+	response.Width, _ = strconv.Atoi(lines[1])
+	response.Height, _ = strconv.Atoi(lines[2])
+	if lines[3] != "Undefined" {
+		response.Orientation = lines[3]
+	}
+	response.OrientedWidth, response.OrientedHeight = response.Width, response.Height
+	if transposingOrientations[response.Orientation] {
+		response.OrientedWidth, response.OrientedHeight = response.Height, response.Width
+	}
+	response.Colorspace = lines[4]
+	response.Depth, _ = strconv.Atoi(lines[5])
+	response.HasAlpha = lines[6] != "False" && lines[6] != "Undefined"
+	response.HasICCProfile = strings.Contains(lines[7], "icc")
+
+	return nil
+}
+
+// getExifFields reads exif:Name=value lines and keeps the selected fields
+func (rh *ResizeHandler) getExifFields(filename string) (map[string]string, error) {
+	start := time.Now()
+	cmd := exec.Command(
+		"identify",
+		"-limit",
+		"memory",
+		rh.memoryLimit,
+		"-limit",
+		"time",
+		rh.timeout,
+		"-quiet",
+		"-format",
+		"%[EXIF:*]",
+		filename)
+	res, err := cmd.Output()
+	durationMs := float64(time.Since(start).Milliseconds())
+	rh.log.Debug("%s: duration: %.2f", cmd.String(), durationMs)
+	if err != nil {
+		return nil, fmt.Errorf("error identify exif %w", err)
+	}
+
+	fields := map[string]string{}
+	for _, line := range strings.Split(string(res), "\n") {
+		name, value, ok := strings.Cut(strings.TrimPrefix(line, "exif:"), "=")
+		if ok && probeExifFields[name] {
+			fields[name] = strings.TrimSpace(value)
+		}
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	return fields, nil
+}
@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"github.com/nocturnecity/image-resizer/pkg"
+)
+
+// StagingPrefix holds outputs of atomic requests until all of them are
+// uploaded, a bucket lifecycle rule may expire leftovers of crashed workers
+const StagingPrefix = "_staging"
+
+// uploadKey is where the output is uploaded to first
+func (rh *ResizeHandler) uploadKey(path string) string {
+	if !rh.Request.Atomic {
+		return path
+	}
+
+	return fmt.Sprintf("%s/%s/%s", StagingPrefix, rh.stagingID, path)
+}
+
+// publishStaged copies staged outputs into their keys once every size is
+// uploaded, staged copies are deleted afterwards. Copies aren't atomic as a
+// whole: a failed copy leaves the sizes copied before it published, the error
+// names them, and the remaining keys with their previous versions.
+func (rh *ResizeHandler) publishStaged(result map[string]pkg.ResultSize) error {
+	var err error
+	if rh.session == nil {
+		rh.session, err = session.NewSession(&aws.Config{
+			Region: aws.String(rh.Request.Region),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create session: %w", err)
+		}
+	}
+	s3Client := s3.New(rh.session)
+	sizeNames := make([]string, 0, len(result))
+	for sizeName := range result {
+		sizeNames = append(sizeNames, sizeName)
+	}
+	sort.Strings(sizeNames)
+	var published []string
+	for _, sizeName := range sizeNames {
+		info := result[sizeName]
+		if info.Status != pkg.SizeStatusGenerated || info.Deduplicated {
+			continue
+		}
+		staged := rh.uploadKey(info.Path)
+		err := rh.withRetry("copy", func() error {
+			_, err := s3Client.CopyObject(&s3.CopyObjectInput{
+				Bucket:     aws.String(rh.Request.BucketName),
+				Key:        aws.String(info.Path),
+				CopySource: aws.String(url.PathEscape(rh.Request.BucketName + "/" + staged)),
+				// ACL isn't copied with the object
+				ACL: aws.String("public-read"),
+			})
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to publish file %q, sizes published before: [%s], %v", info.Path, strings.Join(published, ", "), err)
+		}
+		published = append(published, sizeName)
+		rh.log.Debug("Published file to S3 %s", info.Path)
+	}
+
+	// published, a failure from here on must not delete anything
+	rh.cleanUpAwsFiles.Range(func(key, value any) bool {
+		staged := value.(string)
+		err := rh.withRetry("delete", func() error {
+			_, err := s3Client.DeleteObject(&s3.DeleteObjectInput{
+				Bucket: aws.String(rh.Request.BucketName),
+				Key:    aws.String(staged),
+			})
+			return err
+		})
+		if err != nil {
+			rh.log.Error("failed to delete staged file: %v", err)
+		}
+		rh.cleanUpAwsFiles.Delete(key)
+		return true
+	})
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nocturnecity/image-resizer/pkg"
+)
+
+const DefaultLosslessFormat = "png"
+const DefaultTargetSSIMMaxQuality = 95
+const DefaultTargetSSIMMinQuality = 30
+const DefaultTargetSSIMQualityStep = 5
+
+// quality search makes sense only for formats where quality changes the pixels
+var lossyFormats = map[string]bool{
+	"jpeg": true,
+	"jpg":  true,
+	"webp": true,
+	"avif": true,
+	"heic": true,
+	"jxl":  true,
+}
+
+type qualityResult struct {
+	quality int
+	ssim    float64
+}
+
+// encodeWithTargetSSIM encodes the lossless reference at decreasing quality
+// and keeps the last candidate whose SSIM is still not below the target.
+// If even the highest quality misses the target, that candidate is used.
+func (rh *ResizeHandler) encodeWithTargetSSIM(reference, format string, opt *pkg.ResizeOptions) (string, *qualityResult, error) {
+	maxQuality := DefaultTargetSSIMMaxQuality
+	if opt.ImageQuality > 0 && opt.ImageQuality < maxQuality {
+		maxQuality = opt.ImageQuality
+	}
+
+	var best string
+	var bestResult *qualityResult
+	for quality := maxQuality; quality >= DefaultTargetSSIMMinQuality; quality -= DefaultTargetSSIMQualityStep {
+		candidate := rh.generateRandomFileName(format)
+		err := rh.encodeCommand(reference, candidate, quality)
+		if err != nil {
+			return "", nil, err
+		}
+		score, err := rh.compareSSIM(reference, candidate)
+		if err != nil {
+			return "", nil, err
+		}
+		rh.log.Debug("target ssim %.4f: quality %d scored %.4f", opt.TargetSSIM, quality, score)
+		if score < opt.TargetSSIM && best != "" {
+			break
+		}
+		best = candidate
+		bestResult = &qualityResult{quality: quality, ssim: score}
+		if score < opt.TargetSSIM {
+			break
+		}
+	}
+
+	return best, bestResult, nil
+}
+
+func (rh *ResizeHandler) encodeCommand(filename, result string, quality int) error {
+	start := time.Now()
+	cmd := exec.Command(
+		"magick",
+		"-limit",
+		"memory",
+		rh.memoryLimit,
+		"-limit",
+		"time",
+		rh.timeout,
+		filename,
+		"-quality",
+		strconv.Itoa(quality),
+		result)
+	res, err := cmd.CombinedOutput()
+	durationMs := float64(time.Since(start).Milliseconds())
+	rh.log.Debug("%s: duration: %.2f", cmd.String(), durationMs)
+	if string(res) != "" {
+		rh.log.Debug(string(res))
+	}
+	if err != nil {
+		return fmt.Errorf("error encode file %w, command output: %s", err, res)
+	}
+
+	return nil
+}
+
+func (rh *ResizeHandler) compareSSIM(reference, candidate string) (float64, error) {
+	cmd := exec.Command(
+		"magick",
+		"compare",
+		"-limit",
+		"memory",
+		rh.memoryLimit,
+		"-limit",
+		"time",
+		rh.timeout,
+		"-metric",
+		"SSIM",
+		reference,
+		candidate,
+		"null:")
+	rh.log.Debug(cmd.String())
+	res, err := cmd.CombinedOutput()
+	// compare exits with 1 when images differ, that is the expected outcome here
+	var exitErr *exec.ExitError
+	if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 1) {
+		return 0, fmt.Errorf("error compare files %w, command output: %s", err, res)
+	}
+	fields := strings.Fields(string(res))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("error compare files: empty metric output")
+	}
+	score, err := strconv.ParseFloat(strings.Trim(fields[0], "()"), 64)
+	if err != nil {
+		return 0, fmt.Errorf("error parse ssim metric %q: %w", res, err)
+	}
+
+	return score, nil
+}
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+
+	"github.com/nocturnecity/image-resizer/pkg"
+)
+
+// metadata of stored outputs, in the canonical form S3 returns it
+const (
+	metaSourceETag = "Source-Etag"
+	metaSpecHash   = "Spec-Hash"
+	metaWidth      = "Width"
+	metaHeight     = "Height"
+)
+
+// findUpToDateSizes looks the outputs up before the original is downloaded
+// and returns the sizes which don't need to be generated again
+func (rh *ResizeHandler) findUpToDateSizes() (string, map[string]pkg.ResultSize, error) {
+	source, err := rh.headObject(rh.Request.BucketName, rh.Request.OriginalPath, rh.Request.Region)
+	if err != nil {
+		return "", nil, err
+	}
+	if source == nil {
+		return "", nil, fmt.Errorf("%w: original %q not found", ErrInvalidInput, rh.Request.OriginalPath)
+	}
+	sourceETag := aws.StringValue(source.ETag)
+
+	result := map[string]pkg.ResultSize{}
+	for _, size := range rh.Request.Sizes {
+		format := rh.outputFormat(size)
+		key, err := rh.outputKey(size, format, "", 0)
+		if err != nil {
+			return "", nil, err
+		}
+		stored, err := rh.headObject(rh.Request.BucketName, key, rh.Request.Region)
+		if err != nil {
+			return "", nil, err
+		}
+		if stored == nil {
+			continue
+		}
+		metadata := aws.StringValueMap(stored.Metadata)
+		if rh.Request.Reprocess == pkg.ReprocessIfStale &&
+			(metadata[metaSourceETag] != sourceETag || metadata[metaSpecHash] != rh.specHash(size, format)) {
+			continue
+		}
+		// outputs stored without dimensions are generated again rather than
+		// reported as 0x0
+		width, _ := strconv.Atoi(metadata[metaWidth])
+		height, _ := strconv.Atoi(metadata[metaHeight])
+		if width <= 0 || height <= 0 {
+			continue
+		}
+		result[size.SizeName] = pkg.ResultSize{
+			Path:   key,
+			Width:  width,
+			Height: height,
+			Status: pkg.SizeStatusSkipped,
+		}
+	}
+
+	return sourceETag, result, nil
+}
+
+// needsOriginal tells whether the response needs the original even when no size is generated
+func (rh *ResizeHandler) needsOriginal() bool {
+	return len(rh.Request.Placeholders) > 0 || rh.Request.Palette != nil || len(rh.Request.Hashes) > 0
+}
+
+// specHash changes with anything in the request affecting the output of the size
+func (rh *ResizeHandler) specHash(size pkg.Size, format string) string {
+	spec, _ := json.Marshal(struct {
+		Size      pkg.Size
+		Format    string
+		Document  *pkg.DocumentOptions
+		SVG       *pkg.SVGOptions
+		Transform *pkg.TransformOptions
+		Color     *pkg.ColorOptions
+		Metadata  *pkg.MetadataOptions
+	}{size, format, rh.Request.Document, rh.Request.SVG, rh.Request.Transform, rh.Request.Color, rh.Request.Metadata})
+	hash := sha256.Sum256(spec)
+
+	return hex.EncodeToString(hash[:16])
+}
+
+// outputMetadata is stored with every output for later if_stale runs
+func (rh *ResizeHandler) outputMetadata(size pkg.Size, format, sourceETag string, info *pkg.ResultSize) map[string]*string {
+	metadata := map[string]*string{
+		metaSpecHash: aws.String(rh.specHash(size, format)),
+		metaWidth:    aws.String(strconv.Itoa(info.Width)),
+		metaHeight:   aws.String(strconv.Itoa(info.Height)),
+	}
+	if sourceETag != "" {
+		metadata[metaSourceETag] = aws.String(sourceETag)
+	}
+
+	return metadata
+}
@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const DefaultRetryAttempts = 3
+const DefaultRetryBaseDelay = 200 * time.Millisecond
+const DefaultRetryMaxDelay = 5 * time.Second
+const DefaultRetryJitter = 1.0
+
+// RetryConfig retries whole storage operations, on top of the retries the
+// SDK does for single HTTP requests
+type RetryConfig struct {
+	// Attempts includes the first one, 1 disables retries
+	Attempts  int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Jitter is the randomized share of each delay, 0..1
+	Jitter float64
+}
+
+// Validate rejects values the backoff can't work with, zero values are
+// replaced with defaults later
+func (c RetryConfig) Validate() error {
+	if c.Attempts < 0 {
+		return fmt.Errorf("attempts %d is negative", c.Attempts)
+	}
+
+	if c.BaseDelay < 0 || c.MaxDelay < 0 {
+		return fmt.Errorf("delays %s and %s must not be negative", c.BaseDelay, c.MaxDelay)
+	}
+
+	if c.BaseDelay > 0 && c.MaxDelay > 0 && c.MaxDelay < c.BaseDelay {
+		return fmt.Errorf("max delay %s is less than base delay %s", c.MaxDelay, c.BaseDelay)
+	}
+
+	if c.Jitter < 0 || c.Jitter > 1 {
+		return fmt.Errorf("jitter %v is out of 0..1", c.Jitter)
+	}
+
+	return nil
+}
+
+var storageRetries = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "storage_retries_total",
+		Help: "Total number of retried storage operations.",
+	},
+	[]string{"operation"},
+)
+
+// withRetry runs fn until it succeeds, fails with an error that isn't
+// transient or runs out of attempts
+func (rh *ResizeHandler) withRetry(operation string, fn func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil || attempt >= rh.retry.Attempts || !isRetryableStorageError(err) {
+			return err
+		}
+		storageRetries.WithLabelValues(operation).Inc()
+		delay := rh.retry.backoff(attempt)
+		rh.log.Debug("storage %s attempt %d failed, retrying in %s: %v", operation, attempt, delay, err)
+		time.Sleep(delay)
+	}
+}
+
+// backoff doubles the delay with every attempt up to MaxDelay and
+// randomizes the Jitter share of it
+func (c RetryConfig) backoff(attempt int) time.Duration {
+	delay := c.BaseDelay << (attempt - 1)
+	if delay > c.MaxDelay || delay <= 0 {
+		delay = c.MaxDelay
+	}
+	jitter := time.Duration(c.Jitter * rand.Float64() * float64(delay))
+
+	return delay - jitter
+}
+
+// isRetryableStorageError accepts throttling, 5xx responses and network
+// failures, never client errors like missing keys or denied access
+func isRetryableStorageError(err error) bool {
+	var requestFailure awserr.RequestFailure
+	if errors.As(err, &requestFailure) && requestFailure.StatusCode() >= 500 {
+		return true
+	}
+	// the SDK takes any unknown error as retryable, so only its own are classified by it
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		return request.IsErrorThrottle(awsErr) || request.IsErrorRetryable(awsErr)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return netErr.Timeout()
+	}
+
+	return false
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 
@@ -16,6 +17,13 @@ import (
 	"github.com/nocturnecity/image-resizer/pkg"
 )
 
+// MaxProbeUploadBytes limits originals uploaded to probe and hash
+const MaxProbeUploadBytes = 64 << 20
+
+// ResponseWriteMargin is kept from the server timeout to write the response
+// of a resize which has run out of time
+const ResponseWriteMargin = 5 * time.Second
+
 type Server struct {
 	port              int
 	watermarkProvider *WatermarkProvider
@@ -23,8 +31,11 @@ type Server struct {
 	server            *http.Server
 	pool              *Pool
 	timeout           time.Duration
-	resizeMemoryLimit int
+	resizerConfig     ResizerConfig
+	flights           *flightGroup
 	workersCount      int
+	// results is nil unless the result cache is enabled
+	results *resultCache
 }
 
 // Define a new Prometheus counter
@@ -35,6 +46,41 @@ var resizeRequests = prometheus.NewCounter(
 	},
 )
 
+var probeRequests = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "probe_requests_total",
+		Help: "Total number of probe requests received.",
+	},
+)
+
+var hashRequests = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "hash_requests_total",
+		Help: "Total number of hash requests received.",
+	},
+)
+
+var partialResizes = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "partial_resizes_total",
+		Help: "Total number of partial resize requests with some failed sizes.",
+	},
+)
+
+var coalescedRequests = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "coalesced_requests_total",
+		Help: "Total number of resize requests which shared the result of an identical request in flight.",
+	},
+)
+
+var resultCacheHits = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "result_cache_hits_total",
+		Help: "Total number of resize requests served from the result cache.",
+	},
+)
+
 var queueLength = prometheus.NewGauge(
 	prometheus.GaugeOpts{
 		Name: "queue_length",
@@ -65,12 +111,37 @@ var failedResizes = prometheus.NewCounter(
 	},
 )
 
+var watermarkCacheHits = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "watermark_cache_hits_total",
+		Help: "Total number of watermarks served from cache, including revalidated ones.",
+	},
+)
+
+var watermarkCacheMisses = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "watermark_cache_misses_total",
+		Help: "Total number of watermarks downloaded.",
+	},
+)
+
+var watermarkCacheEvictions = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "watermark_cache_evictions_total",
+		Help: "Total number of watermarks evicted from cache to stay within its size.",
+	},
+)
+
 func (s *Server) Run() {
 	mux := http.NewServeMux()
 
 	// Register a handler function
 	mux.HandleFunc("/resize", s.resizeHandler)
 
+	mux.HandleFunc("/probe", s.probeHandler)
+
+	mux.HandleFunc("/hash", s.hashHandler)
+
 	mux.HandleFunc("/healthz", s.healthzHandler)
 
 	mux.Handle("/metrics", promhttp.Handler())
@@ -88,9 +159,18 @@ func (s *Server) Run() {
 	// Register it with Prometheus
 	prometheus.MustRegister(queueLength)
 	prometheus.MustRegister(resizeRequests)
+	prometheus.MustRegister(probeRequests)
+	prometheus.MustRegister(hashRequests)
+	prometheus.MustRegister(coalescedRequests)
+	prometheus.MustRegister(partialResizes)
+	prometheus.MustRegister(storageRetries)
+	prometheus.MustRegister(resultCacheHits)
 	prometheus.MustRegister(failedResizes)
 	prometheus.MustRegister(resizeDuration)
 	prometheus.MustRegister(resizeDurationWithQueueWait)
+	prometheus.MustRegister(watermarkCacheHits)
+	prometheus.MustRegister(watermarkCacheMisses)
+	prometheus.MustRegister(watermarkCacheEvictions)
 
 	s.pool = NewPool(s.logger, s.workersCount)
 	s.pool.Run()
@@ -139,28 +219,286 @@ func (s *Server) resizeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	handler := NewResizeHandler(req, s.logger, s.watermarkProvider,
-		ResizerConfig{MemoryMB: s.resizeMemoryLimit, TimeoutSec: int(s.timeout.Seconds())})
-	defer handler.Cleanup()
-	resChan := make(chan jobResult)
-	queueLength.Inc()
-	s.pool.Dispatch(job{
-		h: handler,
-		c: resChan,
+	requestFingerprint, err := fingerprint(req)
+	if err != nil {
+		failedResizes.Inc()
+		s.processHttpError(r, w, fmt.Errorf("error fingerprint request: %w", err), http.StatusInternalServerError)
+		return
+	}
+	cacheKey := requestFingerprint
+	if idempotencyKey := r.Header.Get(IdempotencyKeyHeader); idempotencyKey != "" {
+		if len(idempotencyKey) > MaxIdempotencyKeyLength {
+			failedResizes.Inc()
+			s.processHttpError(r, w, fmt.Errorf("%s must not exceed %d characters", IdempotencyKeyHeader, MaxIdempotencyKeyLength), http.StatusBadRequest)
+			return
+		}
+		cacheKey = "key:" + idempotencyKey
+	}
+	if s.results != nil {
+		cached, cachedFingerprint, ok := s.results.Get(cacheKey)
+		if ok && cachedFingerprint != requestFingerprint {
+			failedResizes.Inc()
+			s.processHttpError(r, w, fmt.Errorf("%s was used with another request", IdempotencyKeyHeader), http.StatusUnprocessableEntity)
+			return
+		}
+		if ok {
+			resultCacheHits.Inc()
+			w.Header().Set(IdempotentReplayedHeader, "true")
+			s.processHttpSuccess(r, w, cached)
+			return
+		}
+	}
+
+	// identical requests in flight share one job and its result
+	res, err, shared := s.flights.Do(requestFingerprint, func() (any, error) {
+		return s.processResize(req)
 	})
-	poolRes := <-resChan
-	defer queueLength.Dec()
-	res, err := poolRes.result, poolRes.err
+	if shared {
+		coalescedRequests.Inc()
+	}
 	if err != nil {
-		go handler.CleanupOnError()
 		failedResizes.Inc()
-		s.processHttpError(r, w, fmt.Errorf("failed to process image: %w", err), http.StatusInternalServerError)
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrInvalidInput) {
+			status = http.StatusBadRequest
+		}
+		s.processHttpError(r, w, fmt.Errorf("failed to process image: %w", err), status)
 		return
 	}
+	response := res.(*pkg.Response)
 	durationMs := float64(time.Since(start).Milliseconds())
 	resizeDurationWithQueueWait.Observe(durationMs)
 	s.logger.Debug("RESIZE OBSERVED EXECUTION TIME FOR %s: %.2f sec", req.OriginalPath, durationMs/1000)
-	s.processHttpSuccess(r, w, res)
+	if response.HasFailedSizes() {
+		// not cached, a retry should generate the failed sizes
+		partialResizes.Inc()
+		s.processHttpResponse(r, w, http.StatusMultiStatus, response)
+		return
+	}
+	if s.results != nil && !shared {
+		s.results.Set(cacheKey, requestFingerprint, response)
+	}
+	s.processHttpSuccess(r, w, response)
+}
+
+// processResize runs the request on a worker, the deadline covers the wait
+// for a worker and ends before the server timeout so the error can still be
+// written
+func (s *Server) processResize(req pkg.Request) (*pkg.Response, error) {
+	handler := NewResizeHandler(req, s.logger, s.watermarkProvider, s.resizerConfig)
+	deadline := s.resizeDeadline()
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	// buffered, the worker must not block on a result nobody waits for
+	resChan := make(chan jobResult, 1)
+	queueLength.Inc()
+	defer queueLength.Dec()
+	err := s.pool.Dispatch(ctx, job{
+		name: req.OriginalPath,
+		run: func() (any, error) {
+			// files are removed by the job, it may outlive the wait
+			defer handler.Cleanup()
+			defer cancel()
+			return handler.ProcessRequest(ctx)
+		},
+		c: resChan,
+	})
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("resize of %q timed out after %s waiting for a worker", req.OriginalPath, deadline)
+	}
+	select {
+	case poolRes := <-resChan:
+		if poolRes.err != nil {
+			go handler.CleanupOnError()
+			return nil, poolRes.err
+		}
+		return poolRes.result.(*pkg.Response), nil
+	case <-ctx.Done():
+		// the job stops at its next step; outputs it has already overwritten
+		// in place are kept, deleting them would lose the previous version too
+		go func() {
+			poolRes := <-resChan
+			if poolRes.err == nil {
+				s.logger.Error("resize of %q finished after the deadline, outputs are kept", req.OriginalPath)
+				return
+			}
+			s.logger.Error("resize of %q failed after the deadline: %v", req.OriginalPath, poolRes.err)
+			if req.Atomic {
+				handler.CleanupOnError()
+			}
+		}()
+		return nil, fmt.Errorf("resize of %q timed out after %s", req.OriginalPath, deadline)
+	}
+}
+
+// resizeDeadline leaves a margin of the server timeout for writing the response
+func (s *Server) resizeDeadline() time.Duration {
+	if s.timeout > 2*ResponseWriteMargin {
+		return s.timeout - ResponseWriteMargin
+	}
+
+	return s.timeout / 2
+}
+
+// probeHandler describes a stored original given as JSON or an original
+// uploaded as the raw body with its format in the query string
+func (s *Server) probeHandler(w http.ResponseWriter, r *http.Request) {
+	probeRequests.Inc()
+	if r.Method != "POST" {
+		s.processHttpError(r, w, fmt.Errorf("invalid http method: %s", r.Method), http.StatusNotFound)
+		return
+	}
+
+	var req pkg.ProbeRequest
+	upload := !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+	if upload {
+		req.Format = r.URL.Query().Get("format")
+		if !pkg.IsValidFormat(req.Format) {
+			s.processHttpError(r, w, fmt.Errorf("validation error: format query parameter %q is invalid", req.Format), http.StatusBadRequest)
+			return
+		}
+	} else {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			s.processHttpError(r, w, fmt.Errorf("error unmarshal request: %w", err), http.StatusBadRequest)
+			return
+		}
+		err = req.Validate()
+		if err != nil {
+			s.processHttpError(r, w, fmt.Errorf("validation error: %w", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.inspectOriginal(w, r, req, upload, "probe", func(h *ResizeHandler, filename string) (any, error) {
+		return h.Probe(filename)
+	})
+}
+
+// hashHandler computes perceptual hashes of an original given like for probe,
+// uploads take hashes as a comma separated query parameter
+func (s *Server) hashHandler(w http.ResponseWriter, r *http.Request) {
+	hashRequests.Inc()
+	if r.Method != "POST" {
+		s.processHttpError(r, w, fmt.Errorf("invalid http method: %s", r.Method), http.StatusNotFound)
+		return
+	}
+
+	var req pkg.HashRequest
+	upload := !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+	if upload {
+		req.Format = r.URL.Query().Get("format")
+		if !pkg.IsValidFormat(req.Format) {
+			s.processHttpError(r, w, fmt.Errorf("validation error: format query parameter %q is invalid", req.Format), http.StatusBadRequest)
+			return
+		}
+		if hashes := r.URL.Query().Get("hashes"); hashes != "" {
+			req.Hashes = strings.Split(hashes, ",")
+		}
+		err := pkg.ValidateHashes(req.Hashes)
+		if err != nil {
+			s.processHttpError(r, w, fmt.Errorf("validation error: %w", err), http.StatusBadRequest)
+			return
+		}
+	} else {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			s.processHttpError(r, w, fmt.Errorf("error unmarshal request: %w", err), http.StatusBadRequest)
+			return
+		}
+		err = req.Validate()
+		if err != nil {
+			s.processHttpError(r, w, fmt.Errorf("validation error: %w", err), http.StatusBadRequest)
+			return
+		}
+	}
+	hashes := req.Hashes
+	if len(hashes) == 0 {
+		hashes = pkg.DefaultHashes
+	}
+
+	s.inspectOriginal(w, r, req.ProbeRequest, upload, "hash", func(h *ResizeHandler, filename string) (any, error) {
+		input, err := h.inspectedInput(filename)
+		if err != nil {
+			return nil, err
+		}
+		result, err := h.getHashes(input, hashes)
+		if err != nil {
+			return nil, err
+		}
+		return &pkg.HashResponse{Hashes: result}, nil
+	})
+}
+
+// inspectOriginal saves the uploaded original or downloads the referenced
+// one on a worker and responds with the result of inspect
+func (s *Server) inspectOriginal(w http.ResponseWriter, r *http.Request, req pkg.ProbeRequest, upload bool, name string, inspect func(h *ResizeHandler, filename string) (any, error)) {
+	handler := NewResizeHandler(pkg.Request{
+		OriginalPath: req.OriginalPath,
+		Format:       req.Format,
+		BucketName:   req.BucketName,
+		Region:       req.Region,
+	}, s.logger, s.watermarkProvider, s.resizerConfig)
+	defer handler.Cleanup()
+	filename := handler.generateRandomFileName(req.Format)
+	if upload {
+		err := saveUpload(http.MaxBytesReader(w, r.Body, MaxProbeUploadBytes), filename)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			s.processHttpError(r, w, fmt.Errorf("upload exceeds limit of %d bytes", MaxProbeUploadBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			s.processHttpError(r, w, fmt.Errorf("error reading request body: %w", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	resChan := make(chan jobResult)
+	queueLength.Inc()
+	err := s.pool.Dispatch(r.Context(), job{
+		name: fmt.Sprintf("%s %s", name, req.OriginalPath),
+		run: func() (any, error) {
+			if !upload {
+				_, err := handler.downloadFromS3(req.BucketName, req.OriginalPath, filename, req.Region, "")
+				if err != nil {
+					return nil, err
+				}
+			}
+			return inspect(handler, filename)
+		},
+		c: resChan,
+	})
+	if err != nil {
+		queueLength.Dec()
+		s.processHttpError(r, w, fmt.Errorf("failed to %s image: %w", name, err), http.StatusServiceUnavailable)
+		return
+	}
+	poolRes := <-resChan
+	queueLength.Dec()
+	if poolRes.err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(poolRes.err, ErrInvalidInput) {
+			status = http.StatusBadRequest
+		}
+		s.processHttpError(r, w, fmt.Errorf("failed to %s image: %w", name, poolRes.err), status)
+		return
+	}
+	s.processHttpSuccess(r, w, poolRes.result)
+}
+
+func saveUpload(body io.Reader, filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, body)
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+
+	return closeErr
 }
 
 func (s *Server) isValidRequest(w http.ResponseWriter, r *http.Request) bool {
@@ -195,18 +533,19 @@ func (s *Server) processHttpError(r *http.Request, w http.ResponseWriter, err er
 	}
 }
 
-func (s *Server) processHttpSuccess(r *http.Request, w http.ResponseWriter, sizes map[string]pkg.ResultSize) {
-	response := pkg.Response{
-		Sizes: sizes,
-	}
-	w.WriteHeader(http.StatusOK)
+func (s *Server) processHttpSuccess(r *http.Request, w http.ResponseWriter, response any) {
+	s.processHttpResponse(r, w, http.StatusOK, response)
+}
+
+func (s *Server) processHttpResponse(r *http.Request, w http.ResponseWriter, status int, response any) {
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	err := json.NewEncoder(w).Encode(response)
 	if err != nil {
 		s.processHttpError(r, w, err, http.StatusInternalServerError)
 		return
 	}
-	s.logger.Info("%s %s %d", r.Method, r.URL, http.StatusOK)
+	s.logger.Info("%s %s %d", r.Method, r.URL, status)
 }
 
 func (s *Server) healthzHandler(w http.ResponseWriter, r *http.Request) {
@@ -216,13 +555,25 @@ func (s *Server) healthzHandler(w http.ResponseWriter, r *http.Request) {
 	s.logger.Info("%s %s %d", r.Method, r.URL, http.StatusOK)
 }
 
-func NewHttpServer(port int, timeout time.Duration, memoryLimit, workersCount int, logger *StdLog) *Server {
-	return &Server{
+// NewHttpServer keeps successful resize responses for resultCacheTTL, zero disables the result cache
+func NewHttpServer(port int, timeout time.Duration, workersCount int, resultCacheTTL time.Duration, config ResizerConfig, watermarkConfig WatermarkConfig, logger *StdLog) (*Server, error) {
+	config.TimeoutSec = int(timeout.Seconds())
+	watermarkProvider, err := NewWatermarkProvider(logger, watermarkConfig)
+	if err != nil {
+		return nil, err
+	}
+	server := &Server{
 		port:              port,
 		logger:            logger,
 		timeout:           timeout,
-		resizeMemoryLimit: memoryLimit,
+		resizerConfig:     config,
 		workersCount:      workersCount,
-		watermarkProvider: NewWatermarkProvider(logger),
+		watermarkProvider: watermarkProvider,
+		flights:           newFlightGroup(),
 	}
+	if resultCacheTTL > 0 {
+		server.results = newResultCache(resultCacheTTL)
+	}
+
+	return server, nil
 }
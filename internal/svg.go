@@ -0,0 +1,263 @@
+package internal
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const SVGFormat = "svg"
+const DefaultSVGDensity = 96
+const DefaultMaxSVGElements = 10000
+const DefaultMaxSVGBytes = 5 << 20
+
+// ImageMagick internal renderer, picked explicitly instead of whatever delegate is installed
+const svgCoder = "MSVG"
+
+// elements dropped with their whole subtree
+var svgForbiddenElements = map[string]bool{
+	"script":        true,
+	"foreignobject": true,
+	"iframe":        true,
+	"object":        true,
+	"embed":         true,
+	"handler":       true,
+	"listener":      true,
+}
+
+// rasterizeSVG sanitizes the svg original and renders it into a lossless
+// image used as the original afterwards
+func (rh *ResizeHandler) rasterizeSVG(filename string) (string, error) {
+	start := time.Now()
+	sanitized := rh.generateRandomFileName(SVGFormat)
+	err := rh.sanitizeSVGFile(filename, sanitized)
+	if err != nil {
+		return "", err
+	}
+
+	density := DefaultSVGDensity
+	args := []string{
+		"-limit",
+		"memory",
+		rh.memoryLimit,
+		"-limit",
+		"time",
+		rh.timeout,
+	}
+	opt := rh.Request.SVG
+	if opt != nil && opt.Density > 0 {
+		density = int(opt.Density)
+	}
+	args = append(args,
+		"-density",
+		strconv.Itoa(density),
+		"-background",
+		"none",
+		fmt.Sprintf("%s:%s", svgCoder, sanitized),
+	)
+	if opt != nil && (opt.Width > 0 || opt.Height > 0) {
+		args = append(args, "-resize", svgGeometry(opt.Width, opt.Height))
+	}
+	result := rh.generateRandomFileName(DefaultLosslessFormat)
+	args = append(args, result)
+
+	cmd := exec.Command("magick", args...)
+	res, err := cmd.CombinedOutput()
+	durationMs := float64(time.Since(start).Milliseconds())
+	rh.log.Debug("%s: duration: %.2f", cmd.String(), durationMs)
+	if string(res) != "" {
+		rh.log.Debug(string(res))
+	}
+	if err != nil {
+		return "", fmt.Errorf("error rasterize svg %w, command output: %s", err, res)
+	}
+
+	return result, nil
+}
+
+func svgGeometry(width, height uint) string {
+	geometry := ""
+	if width > 0 {
+		geometry = strconv.Itoa(int(width))
+	}
+	if height > 0 {
+		geometry += "x" + strconv.Itoa(int(height))
+	}
+
+	return geometry
+}
+
+func (rh *ResizeHandler) sanitizeSVGFile(filename, result string) error {
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return fmt.Errorf("error sanitize svg %w", err)
+	}
+	if stat.Size() > DefaultMaxSVGBytes {
+		return fmt.Errorf("%w: svg of %d bytes exceeds limit of %d", ErrInvalidInput, stat.Size(), DefaultMaxSVGBytes)
+	}
+
+	in, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("error sanitize svg %w", err)
+	}
+	defer func(in *os.File) {
+		err := in.Close()
+		if err != nil {
+			rh.log.Error("error closing svg file: %v", err)
+		}
+	}(in)
+	out, err := os.Create(result)
+	if err != nil {
+		return fmt.Errorf("error sanitize svg %w", err)
+	}
+	defer func(out *os.File) {
+		err := out.Close()
+		if err != nil {
+			rh.log.Error("error closing sanitized svg file: %v", err)
+		}
+	}(out)
+
+	return sanitizeSVG(in, out, rh.maxSVGElements)
+}
+
+// sanitizeSVG copies the document dropping scripts, event handlers and
+// references to anything outside of the document itself. Raw tokens are
+// used so namespace prefixes are written back exactly as they were read.
+func sanitizeSVG(r io.Reader, w io.Writer, maxElements int) error {
+	decoder := xml.NewDecoder(r)
+	var out strings.Builder
+	elements := 0
+	// depth of the forbidden subtree being skipped, 0 when copying
+	skipDepth := 0
+	for {
+		token, err := decoder.RawToken()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: malformed svg: %v", ErrInvalidInput, err)
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			elements++
+			if elements > maxElements {
+				return fmt.Errorf("%w: svg has more than %d elements", ErrInvalidInput, maxElements)
+			}
+			if skipDepth > 0 || svgForbiddenElements[strings.ToLower(t.Name.Local)] {
+				skipDepth++
+				continue
+			}
+			if strings.EqualFold(t.Name.Local, "style") {
+				// style sheets are copied only when they don't reach outside
+				text, err := readStyleSheet(decoder)
+				if err != nil {
+					return err
+				}
+				if !hasExternalReference(text) {
+					out.WriteString("<" + qualifiedName(t.Name) + ">")
+					_ = xml.EscapeText(&out, []byte(text))
+					out.WriteString("</" + qualifiedName(t.Name) + ">")
+				}
+				continue
+			}
+			out.WriteString("<" + qualifiedName(t.Name))
+			for _, attr := range t.Attr {
+				if !isSafeSVGAttr(attr) {
+					continue
+				}
+				out.WriteString(" " + qualifiedName(attr.Name) + `="`)
+				_ = xml.EscapeText(&out, []byte(attr.Value))
+				out.WriteString(`"`)
+			}
+			out.WriteString(">")
+		case xml.EndElement:
+			if skipDepth > 0 {
+				skipDepth--
+				continue
+			}
+			out.WriteString("</" + qualifiedName(t.Name) + ">")
+		case xml.CharData:
+			if skipDepth > 0 {
+				continue
+			}
+			_ = xml.EscapeText(&out, t)
+		case xml.ProcInst:
+			if t.Target == "xml" {
+				out.WriteString("<?xml " + string(t.Inst) + "?>")
+			}
+		}
+		// comments and directives (DOCTYPE, entities) are dropped
+	}
+	if elements == 0 {
+		return fmt.Errorf("%w: svg has no elements", ErrInvalidInput)
+	}
+
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+func readStyleSheet(decoder *xml.Decoder) (string, error) {
+	var text strings.Builder
+	depth := 1
+	for depth > 0 {
+		token, err := decoder.RawToken()
+		if err != nil {
+			return "", fmt.Errorf("%w: malformed svg: %v", ErrInvalidInput, err)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			depth++
+		case xml.EndElement:
+			depth--
+		case xml.CharData:
+			text.Write(t)
+		}
+	}
+
+	return text.String(), nil
+}
+
+func isSafeSVGAttr(attr xml.Attr) bool {
+	name := strings.ToLower(attr.Name.Local)
+	if strings.HasPrefix(name, "on") {
+		return false
+	}
+	if name == "href" || name == "src" {
+		// only fragment references inside the document itself
+		return strings.HasPrefix(strings.TrimSpace(attr.Value), "#")
+	}
+
+	return !hasExternalReference(attr.Value)
+}
+
+func hasExternalReference(value string) bool {
+	lower := strings.ToLower(value)
+	if strings.Contains(lower, "@import") || strings.Contains(lower, "javascript:") {
+		return true
+	}
+	for {
+		pos := strings.Index(lower, "url(")
+		if pos == -1 {
+			return false
+		}
+		lower = strings.TrimLeft(lower[pos+len("url("):], " \t\n\r'\"")
+		if !strings.HasPrefix(lower, "#") {
+			return true
+		}
+	}
+}
+
+func qualifiedName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+
+	return name.Space + ":" + name.Local
+}
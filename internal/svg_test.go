@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeSVG(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "fragment href kept",
+			in:   `<svg xmlns:xlink="http://www.w3.org/1999/xlink"><use xlink:href="#a"/></svg>`,
+			want: `<svg xmlns:xlink="http://www.w3.org/1999/xlink"><use xlink:href="#a"></use></svg>`,
+		},
+		{
+			name: "external xlink href dropped",
+			in:   `<svg><image xlink:href="file:///etc/passwd"/></svg>`,
+			want: `<svg><image></image></svg>`,
+		},
+		{
+			name: "external href dropped",
+			in:   `<svg><image href="https://example.com/a.png"/></svg>`,
+			want: `<svg><image></image></svg>`,
+		},
+		{
+			name: "style attribute with url dropped",
+			in:   `<svg><rect style="fill: url( 'https://example.com/a' )" width="1"/></svg>`,
+			want: `<svg><rect width="1"></rect></svg>`,
+		},
+		{
+			name: "style attribute with fragment url kept",
+			in:   `<svg><rect style="fill:url(#g)"/></svg>`,
+			want: `<svg><rect style="fill:url(#g)"></rect></svg>`,
+		},
+		{
+			name: "style sheet with import dropped",
+			in:   `<svg><style>@import "https://example.com/a.css";</style><rect/></svg>`,
+			want: `<svg><rect></rect></svg>`,
+		},
+		{
+			name: "style sheet kept",
+			in:   `<svg><style>rect { fill: red; }</style></svg>`,
+			want: `<svg><style>rect { fill: red; }</style></svg>`,
+		},
+		{
+			name: "script dropped with its subtree",
+			in:   `<svg><script><![CDATA[alert(1)]]></script><rect/></svg>`,
+			want: `<svg><rect></rect></svg>`,
+		},
+		{
+			name: "prefixed script dropped",
+			in:   `<svg:svg xmlns:svg="http://www.w3.org/2000/svg"><svg:script>alert(1)</svg:script></svg:svg>`,
+			want: `<svg:svg xmlns:svg="http://www.w3.org/2000/svg"></svg:svg>`,
+		},
+		{
+			name: "foreign object dropped",
+			in:   `<svg><foreignObject><iframe src="https://example.com"/></foreignObject></svg>`,
+			want: `<svg></svg>`,
+		},
+		{
+			name: "event handlers dropped",
+			in:   `<svg onload="alert(1)"><rect ONCLICK="alert(2)" onmouseover="x" width="1"/></svg>`,
+			want: `<svg><rect width="1"></rect></svg>`,
+		},
+		{
+			name: "javascript url dropped",
+			in:   `<svg><a href="javascript:alert(1)"><rect/></a></svg>`,
+			want: `<svg><a><rect></rect></a></svg>`,
+		},
+		{
+			name: "doctype and internal entities dropped",
+			in:   `<?xml version="1.0"?><!DOCTYPE svg [<!ENTITY a "b">]><!-- c --><svg>&amp;</svg>`,
+			want: `<?xml version="1.0"?><svg>&amp;</svg>`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			err := sanitizeSVG(strings.NewReader(tt.in), &out, DefaultMaxSVGElements)
+			if err != nil {
+				t.Fatalf("sanitizeSVG() error = %v", err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("sanitizeSVG() = %s, want %s", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeSVGRejects(t *testing.T) {
+	tests := []struct {
+		name        string
+		in          string
+		maxElements int
+	}{
+		{
+			name:        "external entity reference",
+			in:          `<!DOCTYPE svg [<!ENTITY xxe SYSTEM "file:///etc/passwd">]><svg>&xxe;</svg>`,
+			maxElements: DefaultMaxSVGElements,
+		},
+		{
+			name:        "entity in attribute",
+			in:          `<!DOCTYPE svg [<!ENTITY a "b">]><svg width="&a;"></svg>`,
+			maxElements: DefaultMaxSVGElements,
+		},
+		{
+			name:        "malformed",
+			in:          `<svg><rect width=1/></svg>`,
+			maxElements: DefaultMaxSVGElements,
+		},
+		{
+			name:        "no elements",
+			in:          `<?xml version="1.0"?>`,
+			maxElements: DefaultMaxSVGElements,
+		},
+		{
+			name:        "too many elements",
+			in:          `<svg><g/><g/><g/></svg>`,
+			maxElements: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			err := sanitizeSVG(strings.NewReader(tt.in), &out, tt.maxElements)
+			if !errors.Is(err, ErrInvalidInput) {
+				t.Fatalf("sanitizeSVG() error = %v, want %v", err, ErrInvalidInput)
+			}
+			if out.Len() != 0 {
+				t.Errorf("sanitizeSVG() wrote %q on error", out.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package internal
+
+import (
+	"fmt"
+
+	"github.com/nocturnecity/image-resizer/pkg"
+)
+
+const DefaultRotateBackground = "white"
+
+// transformArgs translates request transforms into ImageMagick arguments,
+// applied to the auto-oriented original
+func (rh *ResizeHandler) transformArgs(opt *pkg.TransformOptions) []string {
+	if opt == nil {
+		return nil
+	}
+
+	var args []string
+	// kept animations are rejected with trim by checkAnimationTransform
+	if opt.Trim {
+		args = append(args, "-fuzz", fmt.Sprintf("%s%%", formatFloat(opt.TrimFuzz)), "-trim", "+repage")
+	}
+	if opt.Rotate != 0 {
+		background := opt.Background
+		if background == "" {
+			background = DefaultRotateBackground
+		}
+		args = append(args, "-background", background, "-rotate", formatFloat(opt.Rotate), "+repage")
+	}
+	if opt.Flip {
+		args = append(args, "-flip")
+	}
+	if opt.Flop {
+		args = append(args, "-flop")
+	}
+
+	return args
+}
@@ -1,56 +1,243 @@
 package internal
 
 import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
-	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/google/uuid"
 )
 
 const (
-	DefaultCacheTTL        time.Duration = time.Hour
-	DefaultJanitorInterval time.Duration = time.Minute
+	DefaultCacheTTL time.Duration = time.Hour
+	// entries with validators are revalidated this often, a match only extends them
+	DefaultRevalidateInterval time.Duration = 5 * time.Minute
+	// evicted files may still be read by a running resize
+	DefaultEvictionDelay         time.Duration = 5 * time.Minute
+	DefaultCacheSizeMB                         = 256
+	DefaultWatermarkMaxSizeMB                  = 10
+	DefaultWatermarkFetchTimeout time.Duration = 10 * time.Second
+	watermarkMaxRedirects                      = 5
+	// http.DetectContentType looks at this many bytes at most
+	watermarkSniffLen = 512
 )
 
-func NewWatermarkProvider(log *StdLog) *WatermarkProvider {
-	return &WatermarkProvider{
-		cache: newWatermarkCache(log),
-		log:   log,
+const s3Scheme = "s3"
+const watermarkMetaExt = ".json"
+
+// DefaultWatermarkRegionHint is asked for bucket regions when the session has none
+const DefaultWatermarkRegionHint = "us-east-1"
+
+// DefaultWatermarkCacheDir is the volume declared by the image, a temporary
+// directory would be emptied on every restart
+const DefaultWatermarkCacheDir = "/var/cache/image-resizer/watermarks"
+
+// content types a watermark may have, decided by content not by url
+var watermarkContentTypes = map[string]string{
+	"image/png":  "png",
+	"image/jpeg": "jpeg",
+	"image/gif":  "gif",
+	"image/webp": "webp",
+	"image/avif": "avif",
+}
+
+// carrier-grade NAT range, not covered by net.IP.IsPrivate
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+type WatermarkConfig struct {
+	// CacheDir keeps downloaded watermarks between restarts, it must not be
+	// shared with other processes
+	CacheDir    string
+	CacheSizeMB int
+	// MaxSizeMB limits a single watermark file
+	MaxSizeMB int
+	// AllowedHosts limits http(s) hosts and s3 buckets watermarks are
+	// fetched from, "*.example.com" allows subdomains, empty allows any
+	AllowedHosts []string
+	// AllowPrivateNetworks permits http(s) fetches from loopback, private
+	// and link-local addresses such as cloud metadata endpoints
+	AllowPrivateNetworks bool
+	FetchTimeout         time.Duration
+}
+
+func NewWatermarkProvider(log *StdLog, config WatermarkConfig) (*WatermarkProvider, error) {
+	if config.CacheDir == "" {
+		config.CacheDir = DefaultWatermarkCacheDir
+	}
+
+	if config.CacheSizeMB == 0 {
+		config.CacheSizeMB = DefaultCacheSizeMB
+	}
+
+	if config.MaxSizeMB == 0 {
+		config.MaxSizeMB = DefaultWatermarkMaxSizeMB
+	}
+
+	if config.FetchTimeout == 0 {
+		config.FetchTimeout = DefaultWatermarkFetchTimeout
+	}
+
+	cache, err := newWatermarkCache(log, config.CacheDir, int64(config.CacheSizeMB)<<20)
+	if err != nil {
+		return nil, err
+	}
+
+	wp := &WatermarkProvider{
+		cache:        cache,
+		log:          log,
+		flights:      newFlightGroup(),
+		regions:      map[string]string{},
+		maxBytes:     int64(config.MaxSizeMB) << 20,
+		allowedHosts: config.AllowedHosts,
+		fetchTimeout: config.FetchTimeout,
+	}
+	dialer := &net.Dialer{
+		Timeout: config.FetchTimeout,
 	}
+	if !config.AllowPrivateNetworks {
+		// checked after DNS resolution, so neither rebinding nor redirects get around it
+		dialer.Control = checkDialAddress
+	}
+	wp.client = &http.Client{
+		Timeout: config.FetchTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: config.FetchTimeout,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= watermarkMaxRedirects {
+				return fmt.Errorf("%w: too many watermark redirects", ErrInvalidInput)
+			}
+			return wp.checkHost(req.URL.Hostname())
+		},
+	}
+
+	return wp, nil
 }
 
 type WatermarkProvider struct {
-	cache *watermarkCache
-	log   *StdLog
+	cache        *watermarkCache
+	log          *StdLog
+	flights      *flightGroup
+	mu           sync.Mutex
+	session      *session.Session
+	regions      map[string]string
+	client       *http.Client
+	maxBytes     int64
+	allowedHosts []string
+	fetchTimeout time.Duration
 }
 
-func (wp *WatermarkProvider) GetWatermark(url string) (string, string, error) {
-	path, format, ok := wp.cache.Get(url)
-	if ok {
-		return path, format, nil
+// GetWatermark returns the local path and format of the watermark, url is
+// either public http(s) or s3://bucket/key read with the service credentials
+func (wp *WatermarkProvider) GetWatermark(rawUrl string) (string, string, error) {
+	entity, ok := wp.cache.Get(rawUrl)
+	if ok && entity.isFresh() {
+		watermarkCacheHits.Inc()
+		return entity.Path, entity.Format, nil
+	}
+
+	// concurrent misses for the same url share one download
+	val, err, _ := wp.flights.Do(rawUrl, func() (any, error) {
+		return wp.fetch(rawUrl)
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("download watermark error: %w", err)
+	}
+	entity = val.(watermarkCacheEntity)
+
+	return entity.Path, entity.Format, nil
+}
+
+func (wp *WatermarkProvider) fetch(rawUrl string) (watermarkCacheEntity, error) {
+	cached, ok := wp.cache.Get(rawUrl)
+	if ok && cached.isFresh() {
+		watermarkCacheHits.Inc()
+		return cached, nil
+	}
+
+	downloaded, err := wp.download(rawUrl, cached)
+	if err != nil {
+		return watermarkCacheEntity{}, err
 	}
+	if downloaded.notModified {
+		watermarkCacheHits.Inc()
+		return wp.cache.Touch(rawUrl, cached), nil
+	}
+	watermarkCacheMisses.Inc()
+
+	return wp.cache.Set(watermarkCacheEntity{
+		URL:          rawUrl,
+		Path:         downloaded.path,
+		Format:       downloaded.format,
+		ETag:         downloaded.etag,
+		LastModified: downloaded.lastModified,
+		Size:         downloaded.size,
+	}), nil
+}
+
+type downloadedWatermark struct {
+	path         string
+	format       string
+	etag         string
+	lastModified string
+	size         int64
+	notModified  bool
+}
 
-	path, format, err := wp.downloadWatermarkFile(url)
+// download fetches the watermark, conditionally when the cached copy has validators
+func (wp *WatermarkProvider) download(rawUrl string, cached watermarkCacheEntity) (*downloadedWatermark, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to parse watermark url: %v", ErrInvalidInput, err)
+	}
+	err = wp.checkHost(u.Hostname())
 	if err != nil {
-		return "", "", fmt.Errorf("download watermark error: %v", err)
+		return nil, err
+	}
+	if u.Scheme == s3Scheme {
+		return wp.downloadS3WatermarkFile(u, cached)
 	}
-	wp.cache.Set(url, path, format)
 
-	return path, format, nil
+	return wp.downloadWatermarkFile(rawUrl, cached)
 }
 
-func (wp *WatermarkProvider) downloadWatermarkFile(url string) (string, string, error) {
-	response, err := http.Get(url)
+func (wp *WatermarkProvider) downloadWatermarkFile(url string, cached watermarkCacheEntity) (*downloadedWatermark, error) {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %v", err)
+	}
+	if cached.ETag != "" {
+		request.Header.Set("If-None-Match", cached.ETag)
+	}
+	if cached.LastModified != "" {
+		request.Header.Set("If-Modified-Since", cached.LastModified)
+	}
+	response, err := wp.client.Do(request)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to make HTTP request: %v", err)
+		// keep rejections by the dialer and redirect checks recognizable
+		return nil, fmt.Errorf("failed to make HTTP request: %w", err)
 	}
 	defer func(Body io.ReadCloser) {
 		err := Body.Close()
@@ -58,184 +245,433 @@ func (wp *WatermarkProvider) downloadWatermarkFile(url string) (string, string,
 			wp.log.Error("error closing watermark download request body: %v", err)
 		}
 	}(response.Body)
+	if response.StatusCode == http.StatusNotModified && cached.Path != "" {
+		return &downloadedWatermark{notModified: true}, nil
+	}
+	if response.StatusCode >= http.StatusBadRequest && response.StatusCode < http.StatusInternalServerError {
+		return nil, fmt.Errorf("%w: watermark request status code: %d", ErrInvalidInput, response.StatusCode)
+	}
 	if response.StatusCode != http.StatusOK {
-		return "", "", fmt.Errorf("unexpected status code: %d", response.StatusCode)
+		return nil, fmt.Errorf("unexpected status code: %d", response.StatusCode)
+	}
+	if response.ContentLength > wp.maxBytes {
+		return nil, fmt.Errorf("%w: watermark of %d bytes exceeds limit of %d", ErrInvalidInput, response.ContentLength, wp.maxBytes)
+	}
+	path, watermarkFormat, size, err := wp.saveWatermark(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &downloadedWatermark{
+		path:         path,
+		format:       watermarkFormat,
+		etag:         response.Header.Get("ETag"),
+		lastModified: response.Header.Get("Last-Modified"),
+		size:         size,
+	}, nil
+}
+
+func (wp *WatermarkProvider) downloadS3WatermarkFile(u *url.URL, cached watermarkCacheEntity) (*downloadedWatermark, error) {
+	s3Session, err := wp.getSession()
+	if err != nil {
+		return nil, err
+	}
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(u.Host),
+		Key:    aws.String(strings.TrimPrefix(u.Path, "/")),
+	}
+	if cached.ETag != "" {
+		input.IfNoneMatch = aws.String(cached.ETag)
 	}
-	watermarkFormat, err := getFileExtensionFromUrl(url)
+	if lastModified, err := http.ParseTime(cached.LastModified); err == nil {
+		input.IfModifiedSince = aws.Time(lastModified)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), wp.fetchTimeout)
+	defer cancel()
+	region, err := wp.bucketRegion(ctx, s3Session, u.Host)
 	if err != nil {
-		wp.log.Error("can't identify watermark image format: %w", err)
-		watermarkFormat = DefaultJpegFormat
+		return nil, err
+	}
+	output, err := s3.New(s3Session, aws.NewConfig().WithRegion(region)).GetObjectWithContext(ctx, input)
+	var requestFailure awserr.RequestFailure
+	if errors.As(err, &requestFailure) && requestFailure.StatusCode() == http.StatusNotModified && cached.Path != "" {
+		return &downloadedWatermark{notModified: true}, nil
+	}
+	if errors.As(err, &requestFailure) && requestFailure.StatusCode() == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: watermark S3 object not found", ErrInvalidInput)
 	}
-	tempFile, err := os.CreateTemp("", fmt.Sprintf("%s.%s", uuid.New(), watermarkFormat))
 	if err != nil {
-		return "", "", fmt.Errorf("failed to create temporary file: %v", err)
+		return nil, fmt.Errorf("failed to get S3 object: %v", err)
 	}
-	defer func(tempFile *os.File) {
-		err := tempFile.Close()
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
 		if err != nil {
-			wp.log.Error("error closing watermark temporary file: %v", err)
+			wp.log.Error("error closing watermark S3 object body: %v", err)
+		}
+	}(output.Body)
+
+	if aws.Int64Value(output.ContentLength) > wp.maxBytes {
+		return nil, fmt.Errorf("%w: watermark of %d bytes exceeds limit of %d", ErrInvalidInput, aws.Int64Value(output.ContentLength), wp.maxBytes)
+	}
+	path, watermarkFormat, size, err := wp.saveWatermark(output.Body)
+	if err != nil {
+		return nil, err
+	}
+	downloaded := &downloadedWatermark{
+		path:   path,
+		format: watermarkFormat,
+		etag:   aws.StringValue(output.ETag),
+		size:   size,
+	}
+	if output.LastModified != nil {
+		downloaded.lastModified = output.LastModified.UTC().Format(http.TimeFormat)
+	}
+
+	return downloaded, nil
+}
+
+func (wp *WatermarkProvider) getSession() (*session.Session, error) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	if wp.session != nil {
+		return wp.session, nil
+	}
+	s3Session, err := session.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session: %v", err)
+	}
+	wp.session = s3Session
+
+	return s3Session, nil
+}
+
+// bucketRegion looks the region of the bucket up once, watermarks are often
+// kept in an assets bucket of another region than the resized originals
+func (wp *WatermarkProvider) bucketRegion(ctx context.Context, s3Session *session.Session, bucket string) (string, error) {
+	wp.mu.Lock()
+	region, ok := wp.regions[bucket]
+	wp.mu.Unlock()
+	if ok {
+		return region, nil
+	}
+
+	hint := aws.StringValue(s3Session.Config.Region)
+	if hint == "" {
+		hint = DefaultWatermarkRegionHint
+	}
+	region, err := s3manager.GetBucketRegion(ctx, s3Session, bucket, hint)
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == "NotFound" {
+		return "", fmt.Errorf("%w: watermark S3 bucket not found", ErrInvalidInput)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get watermark S3 bucket region: %v", err)
+	}
+	wp.mu.Lock()
+	wp.regions[bucket] = region
+	wp.mu.Unlock()
+
+	return region, nil
+}
+
+// saveWatermark sniffs the format from the first bytes and stores the body
+// into the cache dir as long as it fits the size limit
+func (wp *WatermarkProvider) saveWatermark(body io.Reader) (string, string, int64, error) {
+	head := make([]byte, watermarkSniffLen)
+	n, err := io.ReadFull(body, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", "", 0, fmt.Errorf("failed to read watermark: %v", err)
+	}
+	head = head[:n]
+	watermarkFormat, err := sniffWatermarkFormat(head)
+	if err != nil {
+		return "", "", 0, err
+	}
+	path, size, err := wp.cache.saveFile(io.MultiReader(bytes.NewReader(head), body), watermarkFormat, wp.maxBytes)
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	return path, watermarkFormat, size, nil
+}
+
+func sniffWatermarkFormat(head []byte) (string, error) {
+	// DetectContentType doesn't know avif, its ftyp box brand gives it away
+	if len(head) >= 12 && string(head[4:8]) == "ftyp" && (string(head[8:12]) == "avif" || string(head[8:12]) == "avis") {
+		return "avif", nil
+	}
+	contentType := http.DetectContentType(head)
+	watermarkFormat, ok := watermarkContentTypes[contentType]
+	if !ok {
+		return "", fmt.Errorf("%w: watermark content type %s is not supported", ErrInvalidInput, contentType)
+	}
+
+	return watermarkFormat, nil
+}
+
+// checkHost applies the allowlist to http(s) hosts and s3 buckets
+func (wp *WatermarkProvider) checkHost(host string) error {
+	if len(wp.allowedHosts) == 0 {
+		return nil
+	}
+	host = strings.ToLower(host)
+	for _, allowed := range wp.allowedHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || (strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:])) {
+			return nil
 		}
-	}(tempFile)
-	_, err = io.Copy(tempFile, response.Body)
+	}
+
+	return fmt.Errorf("%w: watermark host %s is not allowed", ErrInvalidInput, host)
+}
+
+func checkDialAddress(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to copy response body to file: %v", err)
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() ||
+		sharedAddressSpace.Contains(ip) {
+		return fmt.Errorf("%w: watermark address %s is not public", ErrInvalidInput, host)
 	}
 
-	format := filepath.Ext(tempFile.Name())
-	return tempFile.Name(), format, nil
+	return nil
 }
 
 func (wp *WatermarkProvider) ShutDown() {
 	wp.cache.Shutdown()
 }
 
-func newWatermarkCache(l *StdLog) *watermarkCache {
+// watermarkCache is a size bounded LRU of watermark files on disk, every
+// file has a json metadata sidecar so the cache survives restarts
+func newWatermarkCache(l *StdLog, dir string, maxBytes int64) (*watermarkCache, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create watermark cache dir: %w", err)
+	}
 	c := &watermarkCache{
-		ttl:      DefaultCacheTTL,
-		entities: map[string]watermarkCacheEntity{},
-		mu:       sync.RWMutex{},
+		dir:      dir,
+		maxBytes: maxBytes,
+		entities: map[string]*list.Element{},
+		lru:      list.New(),
 		l:        l,
 		qc:       make(chan struct{}),
 	}
-	defer runJanitor(c, DefaultJanitorInterval)
-	runtime.SetFinalizer(c, stopJanitor)
-	return c
+	c.load()
+
+	return c, nil
 }
 
 type watermarkCache struct {
-	entities map[string]watermarkCacheEntity
-	ttl      time.Duration
-	mu       sync.RWMutex
-	qc       chan struct{}
-	j        *janitor
-	l        *StdLog
+	dir      string
+	maxBytes int64
+	size     int64
+	entities map[string]*list.Element
+	// most recently used in front
+	lru *list.List
+	mu  sync.Mutex
+	qc  chan struct{}
+	l   *StdLog
 }
 
 type watermarkCacheEntity struct {
-	path      string
-	format    string
-	expiredAt int64
+	URL          string `json:"url"`
+	Path         string `json:"path"`
+	Format       string `json:"format"`
+	ETag         string `json:"etag"`
+	LastModified string `json:"last_modified"`
+	Size         int64  `json:"size"`
+	ValidatedAt  int64  `json:"validated_at"`
 }
 
-func (w *watermarkCache) Get(key string) (string, string, bool) {
-	w.mu.RLock()
-	defer w.mu.RUnlock()
-	val, ok := w.entities[key]
-	if !ok {
-		return "", "", false
+func (e watermarkCacheEntity) isFresh() bool {
+	ttl := DefaultCacheTTL
+	// with validators a revalidation is cheap, without them it is a full download
+	if e.ETag != "" || e.LastModified != "" {
+		ttl = DefaultRevalidateInterval
 	}
 
-	return val.path, val.format, true
+	return time.Since(time.Unix(0, e.ValidatedAt)) < ttl
 }
 
-func (w *watermarkCache) Set(key, path, format string) {
+func (w *watermarkCache) Get(key string) (watermarkCacheEntity, bool) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	w.entities[key] = watermarkCacheEntity{
-		path:      path,
-		format:    format,
-		expiredAt: time.Now().Add(w.ttl).UnixNano(),
+	element, ok := w.entities[key]
+	if !ok {
+		return watermarkCacheEntity{}, false
 	}
+	w.lru.MoveToFront(element)
+
+	return element.Value.(watermarkCacheEntity), true
 }
 
-func (w *watermarkCache) Shutdown() {
+func (w *watermarkCache) Set(entity watermarkCacheEntity) watermarkCacheEntity {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	close(w.qc)
-	for k, v := range w.entities {
-		w.clearEntity(k, v.path)
+	if element, ok := w.entities[entity.URL]; ok {
+		w.remove(element)
 	}
-	stopJanitor(w)
+	entity.ValidatedAt = time.Now().UnixNano()
+	w.add(entity)
+	w.writeMeta(entity)
+	w.evict()
+
+	return entity
 }
 
-func (w *watermarkCache) DeleteExpired() {
+// Touch marks an entity confirmed to be up to date
+func (w *watermarkCache) Touch(key string, entity watermarkCacheEntity) watermarkCacheEntity {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	now := time.Now().UnixNano()
-	for k, v := range w.entities {
-		if now > v.expiredAt {
-			w.onExpired(k, v.path)
-		}
+	element, ok := w.entities[key]
+	if !ok {
+		return entity
 	}
+	entity = element.Value.(watermarkCacheEntity)
+	entity.ValidatedAt = time.Now().UnixNano()
+	element.Value = entity
+	w.lru.MoveToFront(element)
+	w.writeMeta(entity)
+
+	return entity
 }
 
-// prevent deleting during resize process
-func (w *watermarkCache) onExpired(key, toDelete string) {
-	delete(w.entities, key)
-	go func() {
-		timer := time.NewTimer(5 * time.Minute)
-		for {
-			select {
-			case <-timer.C:
-				err := os.Remove(toDelete)
-				if err != nil {
-					w.l.Error("error clean up file delete: %v", err)
-				}
-				if !timer.Stop() {
-					<-timer.C
-				}
-				return
-			case <-w.qc:
-				err := os.Remove(toDelete)
-				if err != nil {
-					w.l.Error("error clean up file delete: %v", err)
-				}
-				if !timer.Stop() {
-					<-timer.C
-				}
-				return
-			}
-		}
-	}()
+func (w *watermarkCache) Shutdown() {
+	close(w.qc)
 }
 
-func (w *watermarkCache) clearEntity(key, toDelete string) {
-	delete(w.entities, key)
-	err := os.Remove(toDelete)
-	if err != nil {
+func (w *watermarkCache) add(entity watermarkCacheEntity) {
+	w.entities[entity.URL] = w.lru.PushFront(entity)
+	w.size += entity.Size
+}
+
+// remove drops the entity, its file is deleted with a delay
+func (w *watermarkCache) remove(element *list.Element) {
+	entity := element.Value.(watermarkCacheEntity)
+	w.lru.Remove(element)
+	delete(w.entities, entity.URL)
+	w.size -= entity.Size
+	err := os.Remove(w.metaPath(entity.URL))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
 		w.l.Error("error clean up file delete: %v", err)
 	}
+	w.deleteLater(entity.Path)
 }
 
-type janitor struct {
-	Interval time.Duration
-	stop     chan bool
+func (w *watermarkCache) evict() {
+	for w.size > w.maxBytes && w.lru.Len() > 1 {
+		w.remove(w.lru.Back())
+		watermarkCacheEvictions.Inc()
+	}
 }
 
-func (j *janitor) Run(c *watermarkCache) {
-	ticker := time.NewTicker(j.Interval)
-	for {
+func (w *watermarkCache) deleteLater(toDelete string) {
+	go func() {
+		timer := time.NewTimer(DefaultEvictionDelay)
+		defer timer.Stop()
 		select {
-		case <-ticker.C:
-			c.DeleteExpired()
-		case <-j.stop:
-			ticker.Stop()
-			return
+		case <-timer.C:
+		case <-w.qc:
+		}
+		err := os.Remove(toDelete)
+		if err != nil {
+			w.l.Error("error clean up file delete: %v", err)
+		}
+	}()
+}
+
+// saveFile writes a downloaded watermark into the cache dir under a unique
+// name, a replaced version keeps its own file until it is deleted
+func (w *watermarkCache) saveFile(body io.Reader, format string, maxBytes int64) (string, int64, error) {
+	path := filepath.Join(w.dir, fmt.Sprintf("%s.%s", uuid.New(), format))
+	file, err := os.Create(path)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create watermark file: %v", err)
+	}
+	// one byte over the limit is enough to tell the body is too large
+	size, err := io.Copy(file, io.LimitReader(body, maxBytes+1))
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil && size > maxBytes {
+		err = fmt.Errorf("%w: watermark exceeds limit of %d bytes", ErrInvalidInput, maxBytes)
+	}
+	if err != nil {
+		removeErr := os.Remove(path)
+		if removeErr != nil {
+			w.l.Error("error clean up file delete: %v", removeErr)
 		}
+		return "", 0, fmt.Errorf("failed to copy response body to file: %w", err)
 	}
+
+	return path, size, nil
 }
 
-func stopJanitor(c *watermarkCache) {
-	c.j.stop <- true
+func (w *watermarkCache) metaPath(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(w.dir, hex.EncodeToString(hash[:])+watermarkMetaExt)
 }
 
-func runJanitor(c *watermarkCache, ci time.Duration) {
-	j := &janitor{
-		Interval: ci,
-		stop:     make(chan bool),
+func (w *watermarkCache) writeMeta(entity watermarkCacheEntity) {
+	data, err := json.Marshal(entity)
+	if err == nil {
+		err = os.WriteFile(w.metaPath(entity.URL), data, 0o644)
+	}
+	if err != nil {
+		w.l.Error("error write watermark cache metadata: %v", err)
 	}
-	c.j = j
-	go j.Run(c)
 }
 
-func getFileExtensionFromUrl(rawUrl string) (string, error) {
-	u, err := url.Parse(rawUrl)
+// load restores entities from metadata sidecars, least recently validated
+// ones end up at the back, files without metadata are leftovers and removed
+func (w *watermarkCache) load() {
+	files, err := os.ReadDir(w.dir)
 	if err != nil {
-		return "", err
+		w.l.Error("error read watermark cache dir: %v", err)
+		return
+	}
+	var loaded []watermarkCacheEntity
+	known := map[string]bool{}
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != watermarkMetaExt {
+			continue
+		}
+		metaPath := filepath.Join(w.dir, file.Name())
+		var entity watermarkCacheEntity
+		data, err := os.ReadFile(metaPath)
+		if err == nil {
+			err = json.Unmarshal(data, &entity)
+		}
+		if err == nil {
+			_, err = os.Stat(entity.Path)
+		}
+		if err != nil {
+			w.l.Error("error load watermark cache entity %s: %v", file.Name(), err)
+			_ = os.Remove(metaPath)
+			continue
+		}
+		known[file.Name()] = true
+		known[filepath.Base(entity.Path)] = true
+		loaded = append(loaded, entity)
 	}
-	pos := strings.LastIndex(u.Path, ".")
-	if pos == -1 {
-		return "", fmt.Errorf("couldn't find a period to indicate a file extension")
+	for _, file := range files {
+		if !file.IsDir() && !known[file.Name()] {
+			_ = os.Remove(filepath.Join(w.dir, file.Name()))
+		}
+	}
+
+	sort.Slice(loaded, func(i, j int) bool {
+		return loaded[i].ValidatedAt < loaded[j].ValidatedAt
+	})
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, entity := range loaded {
+		w.add(entity)
 	}
-	return u.Path[pos+1 : len(u.Path)], nil
+	w.evict()
+	w.l.Info("Watermark cache loaded %d entities, %d bytes", w.lru.Len(), w.size)
 }
@@ -1,18 +1,20 @@
 package internal
 
 import (
+	"context"
+	"fmt"
 	"sync"
-
-	"github.com/nocturnecity/image-resizer/pkg"
 )
 
+// job runs on a worker, name is only logged
 type job struct {
-	h *ResizeHandler
-	c chan jobResult
+	name string
+	run  func() (any, error)
+	c    chan jobResult
 }
 
 type jobResult struct {
-	result map[string]pkg.ResultSize
+	result any
 	err    error
 }
 
@@ -43,9 +45,15 @@ func (d *Pool) Run() {
 	}
 }
 
-func (d *Pool) Dispatch(j job) {
-	jobChannel := <-d.wq
-	jobChannel <- j
+// Dispatch waits for a free worker until ctx is done, the job is not run then
+func (d *Pool) Dispatch(ctx context.Context, j job) error {
+	select {
+	case jobChannel := <-d.wq:
+		jobChannel <- j
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (d *Pool) ShutDown() {
@@ -76,7 +84,7 @@ func (w *Worker) start() {
 		w.logger.Info("Worker spawned")
 		defer func() {
 			if r := recover(); r != nil {
-				w.logger.Error("worker panic recover: %w", r)
+				w.logger.Error("worker panic recover: %v", r)
 				w.start()
 			}
 		}()
@@ -84,12 +92,8 @@ func (w *Worker) start() {
 			w.wq <- w.jq
 			select {
 			case rq := <-w.jq:
-				w.logger.Debug("Worker processing request %v", rq.h.Request)
-				result, err := rq.h.ProcessRequest()
-				rq.c <- jobResult{
-					result,
-					err,
-				}
+				w.logger.Debug("Worker processing request %v", rq.name)
+				rq.c <- w.run(rq)
 			case <-w.qc:
 				w.logger.Debug("Worker quit channel triggered")
 				w.wg.Done()
@@ -98,3 +102,19 @@ func (w *Worker) start() {
 		}
 	}()
 }
+
+// run turns a panic of the job into its result, the dispatcher waits for one
+func (w *Worker) run(rq job) (res jobResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			w.logger.Error("job %v panic recover: %v", rq.name, r)
+			res = jobResult{err: fmt.Errorf("job panicked: %v", r)}
+		}
+	}()
+	result, err := rq.run()
+
+	return jobResult{
+		result,
+		err,
+	}
+}
@@ -0,0 +1,101 @@
+package pkg
+
+import (
+	"fmt"
+	"regexp"
+)
+
+const MaxAdjustments = 10
+
+const (
+	AdjustmentSharpen    = "sharpen"
+	AdjustmentBlur       = "blur"
+	AdjustmentBrightness = "brightness"
+	AdjustmentContrast   = "contrast"
+	AdjustmentSaturation = "saturation"
+	AdjustmentGamma      = "gamma"
+	AdjustmentGrayscale  = "grayscale"
+	AdjustmentSepia      = "sepia"
+	AdjustmentTint       = "tint"
+)
+
+// Adjustment is a single image operation, only parameters of its Type are used
+// and zero values of kernel parameters fall back to defaults
+type Adjustment struct {
+	Type string `json:"type"`
+	// Radius and Sigma of sharpen (unsharp mask) and blur kernels
+	Radius float64 `json:"radius"`
+	Sigma  float64 `json:"sigma"`
+	// Amount and Threshold of sharpen
+	Amount    float64 `json:"amount"`
+	Threshold float64 `json:"threshold"`
+	// Value is the strength, an omitted one takes the default of the type:
+	// brightness and contrast -100..100 (0), saturation percent 0..300 (100
+	// keeps colors), gamma 0.1..10 (1), sepia percent 0..100 (80) and tint
+	// percent 0..100 (50)
+	Value *float64 `json:"value"`
+	// Color of tint
+	Color string `json:"color"`
+}
+
+func (a *Adjustment) Validate() error {
+	switch a.Type {
+	case AdjustmentSharpen:
+		if err := checkRange("radius", a.Radius, 0, 10); err != nil {
+			return err
+		}
+		if err := checkRange("sigma", a.Sigma, 0, 10); err != nil {
+			return err
+		}
+		if err := checkRange("amount", a.Amount, 0, 5); err != nil {
+			return err
+		}
+		return checkRange("threshold", a.Threshold, 0, 1)
+	case AdjustmentBlur:
+		if err := checkRange("radius", a.Radius, 0, 50); err != nil {
+			return err
+		}
+		return checkRange("sigma", a.Sigma, 0, 50)
+	case AdjustmentBrightness, AdjustmentContrast:
+		return checkOptionalRange("value", a.Value, -100, 100)
+	case AdjustmentSaturation:
+		return checkOptionalRange("value", a.Value, 0, 300)
+	case AdjustmentGamma:
+		return checkOptionalRange("value", a.Value, 0.1, 10)
+	case AdjustmentGrayscale:
+		return nil
+	case AdjustmentSepia:
+		return checkOptionalRange("value", a.Value, 0, 100)
+	case AdjustmentTint:
+		if !IsValidColor(a.Color) {
+			return fmt.Errorf("color %q is invalid", a.Color)
+		}
+		return checkOptionalRange("value", a.Value, 0, 100)
+	}
+
+	return fmt.Errorf("unknown type %q", a.Type)
+}
+
+func checkRange(name string, value, min, max float64) error {
+	if value < min || value > max {
+		return fmt.Errorf("%s must be in range [%g, %g]", name, min, max)
+	}
+
+	return nil
+}
+
+func checkOptionalRange(name string, value *float64, min, max float64) error {
+	if value == nil {
+		return nil
+	}
+
+	return checkRange(name, *value, min, max)
+}
+
+var colorPattern = regexp.MustCompile(`^(#[0-9a-fA-F]{3,4}|#[0-9a-fA-F]{6}|#[0-9a-fA-F]{8}|[a-zA-Z]{3,20}|rgba?\(\s*\d{1,3}\s*,\s*\d{1,3}\s*,\s*\d{1,3}\s*(,\s*(0|1|0?\.\d+)\s*)?\))$`)
+
+// IsValidColor accepts hex, named and rgb()/rgba() colors, nothing that
+// ImageMagick could read as a file or an expression
+func IsValidColor(color string) bool {
+	return colorPattern.MatchString(color)
+}
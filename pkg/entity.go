@@ -1,9 +1,37 @@
 package pkg
 
+const AnimationPoster = "poster"
+const AnimationPreserve = "preserve"
+
+const PlaceholderBlurHash = "blurhash"
+const PlaceholderThumbHash = "thumbhash"
+const PlaceholderLQIP = "lqip"
+
+const SizeStatusGenerated = "generated"
+const SizeStatusSkipped = "skipped"
+const SizeStatusFailed = "failed"
+
+const MaskCircle = "circle"
+const MaskRoundedRect = "rounded"
+const MaskImage = "image"
+
 type ResultSize struct {
-	Path   string `json:"path"`
-	Width  int    `json:"width"`
-	Height int    `json:"height"`
+	Path    string  `json:"path"`
+	Width   int     `json:"width"`
+	Height  int     `json:"height"`
+	Quality int     `json:"quality,omitempty"`
+	SSIM    float64 `json:"ssim,omitempty"`
+	// Frames and DurationMs are reported for animated outputs only
+	Frames     int `json:"frames,omitempty"`
+	DurationMs int `json:"duration_ms,omitempty"`
+	// Deduplicated is set when a content-addressed key was stored already and the upload was skipped
+	Deduplicated bool `json:"deduplicated,omitempty"`
+	// Status is generated, skipped when the stored output was up to date or
+	// failed in partial mode
+	Status string `json:"status,omitempty"`
+	// Error tells briefly why the size failed: processing failed, upload
+	// failed or invalid input
+	Error string `json:"error,omitempty"`
 }
 
 type Size struct {
@@ -13,6 +41,16 @@ type Size struct {
 	WaterMarkOptions *WaterMarkOptions `json:"water_mark_options"`
 	KeepFormat       bool              `json:"keep_format"`
 	Format           string            `json:"format"`
+	// Animation is "poster" (default) to take the first frame of an animated
+	// original or "preserve" to keep animation when the output format supports it
+	Animation string `json:"animation"`
+	// Adjustments are applied in order after resize and crop, before watermark
+	Adjustments []Adjustment `json:"adjustments"`
+	// Mask cuts the final image into a shape, the output is switched to png
+	// unless the format keeps transparency or a mask background is given
+	Mask *MaskOptions `json:"mask"`
+	// WaterMarks are layered in order over the image, after WaterMarkOptions
+	WaterMarks []WaterMarkOptions `json:"water_marks"`
 }
 
 type ResizeOptions struct {
@@ -20,6 +58,9 @@ type ResizeOptions struct {
 	Y            uint `json:"y"`
 	QuickResize  bool `json:"quick_resize"`
 	ImageQuality int  `json:"image_quality"`
+	// TargetSSIM picks the lowest encoder quality (capped by ImageQuality)
+	// whose structural similarity to the resized image stays above the target
+	TargetSSIM float64 `json:"target_ssim"`
 }
 
 type CropOptions struct {
@@ -29,10 +70,22 @@ type CropOptions struct {
 	Y      int  `json:"y"`
 }
 
-type WaterMarkOptions struct {
-	WatermarkImageURL string `json:"water_mark_image_url"`
-	Width             uint   `json:"width"`
-	Height            uint   `json:"height"`
-	X                 int    `json:"x"`
-	Y                 int    `json:"y"`
+type MaskOptions struct {
+	Type string `json:"type"`
+	// Radius of rounded rectangle corners in pixels
+	Radius uint `json:"radius"`
+	// ImageURL of the mask image, its luminance becomes the opacity
+	ImageURL string `json:"image_url"`
+	// Background flattens the masked image onto a color instead of transparency
+	Background string `json:"background"`
+}
+
+// WaterMarkLayers lists all watermarks of the size in composition order
+func (s *Size) WaterMarkLayers() []WaterMarkOptions {
+	var layers []WaterMarkOptions
+	if s.WaterMarkOptions != nil {
+		layers = append(layers, *s.WaterMarkOptions)
+	}
+
+	return append(layers, s.WaterMarks...)
 }
@@ -0,0 +1,60 @@
+package pkg
+
+import (
+	"fmt"
+	"math/bits"
+	"strconv"
+)
+
+const (
+	HashAverage    = "ahash"
+	HashDifference = "dhash"
+	HashPerceptual = "phash"
+)
+
+// DefaultHashes are computed by the hash endpoint when none are listed
+var DefaultHashes = []string{HashAverage, HashDifference, HashPerceptual}
+
+type HashRequest struct {
+	ProbeRequest
+	// Hashes lists ahash, dhash and phash, all of them by default
+	Hashes []string `json:"hashes"`
+}
+
+func (req *HashRequest) Validate() error {
+	if err := req.ProbeRequest.Validate(); err != nil {
+		return err
+	}
+
+	return ValidateHashes(req.Hashes)
+}
+
+type HashResponse struct {
+	// Hashes are 64-bit, hex encoded
+	Hashes map[string]string `json:"hashes"`
+}
+
+func ValidateHashes(hashes []string) error {
+	for i, hash := range hashes {
+		if hash != HashAverage && hash != HashDifference && hash != HashPerceptual {
+			return fmt.Errorf("hashes[%d] must be one of: %s, %s, %s", i, HashAverage, HashDifference, HashPerceptual)
+		}
+	}
+
+	return nil
+}
+
+// HammingDistance counts differing bits of two hex encoded hashes of the
+// same kind, similar images are a few bits apart
+func HammingDistance(a, b string) (int, error) {
+	x, err := strconv.ParseUint(a, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("hash %q is invalid: %w", a, err)
+	}
+	y, err := strconv.ParseUint(b, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("hash %q is invalid: %w", b, err)
+	}
+
+	return bits.OnesCount64(x ^ y), nil
+}
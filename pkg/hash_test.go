@@ -0,0 +1,40 @@
+package pkg
+
+import (
+	"testing"
+)
+
+func TestHammingDistance(t *testing.T) {
+	tests := []struct {
+		a, b    string
+		want    int
+		wantErr bool
+	}{
+		{a: "0000000000000000", b: "0000000000000000", want: 0},
+		{a: "ffffffffffffffff", b: "0000000000000000", want: 64},
+		{a: "f0f0f0f0f0f0f0f0", b: "0f0f0f0f0f0f0f0f", want: 64},
+		{a: "8000000000000001", b: "0000000000000000", want: 2},
+		{a: "00000000000000ff", b: "ff", want: 0},
+		{a: "zz", b: "0000000000000000", wantErr: true},
+		{a: "0000000000000000", b: "", wantErr: true},
+		{a: "1ffffffffffffffff", b: "0000000000000000", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := HammingDistance(tt.a, tt.b)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("HammingDistance(%q, %q) error = %v, wantErr %v", tt.a, tt.b, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("HammingDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestValidateHashes(t *testing.T) {
+	if err := ValidateHashes([]string{HashAverage, HashDifference, HashPerceptual}); err != nil {
+		t.Errorf("ValidateHashes() error = %v", err)
+	}
+	if err := ValidateHashes([]string{HashAverage, "md5"}); err == nil {
+		t.Errorf("ValidateHashes() accepted an unknown hash")
+	}
+}
@@ -0,0 +1,53 @@
+package pkg
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	KeyHash             = "{hash}"
+	KeySize             = "{size}"
+	KeyWidth            = "{width}"
+	KeyFormat           = "{format}"
+	KeyOriginalBasename = "{original_basename}"
+)
+
+var keyPlaceholderPattern = regexp.MustCompile(`\{[^{}]*\}`)
+
+var keyPlaceholders = map[string]bool{
+	KeyHash:             true,
+	KeySize:             true,
+	KeyWidth:            true,
+	KeyFormat:           true,
+	KeyOriginalBasename: true,
+}
+
+// ValidateKeyTemplate accepts known placeholders and keys relative to path_to_save,
+// {size} or {hash} keeps keys of different sizes apart
+func ValidateKeyTemplate(template string) error {
+	for _, placeholder := range keyPlaceholderPattern.FindAllString(template, -1) {
+		if !keyPlaceholders[placeholder] {
+			return fmt.Errorf("placeholder %s is unknown", placeholder)
+		}
+	}
+	if !strings.Contains(template, KeySize) && !IsContentAddressed(template) {
+		return fmt.Errorf("must contain %s or %s", KeySize, KeyHash)
+	}
+	if strings.HasPrefix(template, "/") {
+		return fmt.Errorf("must be relative to path_to_save")
+	}
+	for _, part := range strings.Split(template, "/") {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("must not contain empty, . or .. segments")
+		}
+	}
+
+	return nil
+}
+
+// IsContentAddressed tells whether keys of the template change with the content
+func IsContentAddressed(template string) bool {
+	return strings.Contains(template, KeyHash)
+}
@@ -0,0 +1,89 @@
+package pkg
+
+import (
+	"fmt"
+	"unicode"
+)
+
+const (
+	MetadataStrip = "strip"
+	MetadataKeep  = "keep"
+)
+
+const MaxMetadataValueLength = 200
+
+// metadataTags can be kept from the original, location and camera tags are
+// never among them
+var metadataTags = map[string]bool{
+	"Copyright":       true,
+	"CopyrightNotice": true,
+	"Rights":          true,
+	"UsageTerms":      true,
+	"WebStatement":    true,
+	"Artist":          true,
+	"Creator":         true,
+	"By-line":         true,
+	"Credit":          true,
+	"Source":          true,
+	"Title":           true,
+	"Description":     true,
+}
+
+// DefaultMetadataTags are kept when the keep policy lists no tags
+var DefaultMetadataTags = []string{"Copyright", "CopyrightNotice", "Rights", "Artist", "Creator", "By-line", "Credit"}
+
+// MetadataOptions decides which EXIF/IPTC/XMP tags sizes carry, GPS and the
+// rest of the original metadata are dropped under any policy
+type MetadataOptions struct {
+	// Policy is strip (default) or keep
+	Policy string `json:"policy"`
+	// Tags kept by the keep policy, DefaultMetadataTags when empty
+	Tags []string `json:"tags"`
+	// Copyright and Artist are written to sizes, replacing kept values
+	Copyright string `json:"copyright"`
+	Artist    string `json:"artist"`
+}
+
+func (m *MetadataOptions) Validate() error {
+	if m.Policy != "" && m.Policy != MetadataStrip && m.Policy != MetadataKeep {
+		return fmt.Errorf("policy %q is unknown", m.Policy)
+	}
+	if len(m.Tags) > 0 && m.Policy != MetadataKeep {
+		return fmt.Errorf("tags require %q policy", MetadataKeep)
+	}
+	for _, tag := range m.Tags {
+		if !metadataTags[tag] {
+			return fmt.Errorf("tag %q can't be kept", tag)
+		}
+	}
+	if err := checkMetadataValue("copyright", m.Copyright); err != nil {
+		return err
+	}
+
+	return checkMetadataValue("artist", m.Artist)
+}
+
+// KeptTags returns the tags copied from the original
+func (m *MetadataOptions) KeptTags() []string {
+	if m.Policy != MetadataKeep {
+		return nil
+	}
+	if len(m.Tags) == 0 {
+		return DefaultMetadataTags
+	}
+
+	return m.Tags
+}
+
+func checkMetadataValue(name, value string) error {
+	if len(value) > MaxMetadataValueLength {
+		return fmt.Errorf("%s must not exceed %d characters", name, MaxMetadataValueLength)
+	}
+	for _, r := range value {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("%s must not contain control characters", name)
+		}
+	}
+
+	return nil
+}
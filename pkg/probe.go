@@ -0,0 +1,68 @@
+package pkg
+
+import (
+	"fmt"
+	"regexp"
+)
+
+var formatPattern = regexp.MustCompile(`^[a-z0-9]{2,5}$`)
+
+// ProbeRequest points at a stored original, uploaded originals take Format
+// from the query string instead
+type ProbeRequest struct {
+	OriginalPath string `json:"original_path"`
+	Format       string `json:"format"`
+	BucketName   string `json:"bucket_name"`
+	Region       string `json:"region"`
+}
+
+func (req *ProbeRequest) Validate() error {
+	if req.Format == "" {
+		return fmt.Errorf("format is requered field")
+	}
+
+	if !IsValidFormat(req.Format) {
+		return fmt.Errorf("format %q is invalid", req.Format)
+	}
+
+	if req.BucketName == "" {
+		return fmt.Errorf("bucket_name is requered field")
+	}
+
+	if req.OriginalPath == "" {
+		return fmt.Errorf("original_path is requered field")
+	}
+
+	if req.Region == "" {
+		return fmt.Errorf("region is requered field")
+	}
+
+	return nil
+}
+
+// IsValidFormat accepts lowercase file extensions only, the format ends up
+// in file names
+func IsValidFormat(format string) bool {
+	return formatPattern.MatchString(format)
+}
+
+type ProbeResponse struct {
+	// Format is the one ImageMagick has detected
+	Format string `json:"format"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	// OrientedWidth and OrientedHeight are dimensions as the image is viewed
+	OrientedWidth  int    `json:"oriented_width"`
+	OrientedHeight int    `json:"oriented_height"`
+	Orientation    string `json:"orientation,omitempty"`
+	Colorspace     string `json:"colorspace"`
+	HasICCProfile  bool   `json:"has_icc_profile"`
+	Depth          int    `json:"depth"`
+	HasAlpha       bool   `json:"has_alpha"`
+	// Frames of animated originals, Pages of documents
+	Frames   int   `json:"frames"`
+	Pages    int   `json:"pages,omitempty"`
+	FileSize int64 `json:"file_size"`
+	// Exif holds selected camera and rights fields, location is never included
+	Exif map[string]string `json:"exif,omitempty"`
+}
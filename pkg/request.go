@@ -1,6 +1,18 @@
 package pkg
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
+
+const MaxDocumentDensity = 600
+const MaxContactSheetColumns = 10
+const MaxSVGDensity = 1200
+const MaxSVGSide = 8192
+const MaxPaletteColors = 16
+
+const ReprocessIfMissing = "if_missing"
+const ReprocessIfStale = "if_stale"
 
 type Request struct {
 	OriginalPath string `json:"original_path"`
@@ -9,6 +21,82 @@ type Request struct {
 	BucketName   string `json:"bucket_name"`
 	Sizes        []Size `json:"sizes"`
 	Region       string `json:"region"`
+	// Document applies to multi-page originals (pdf, tiff), single-page tiffs
+	// without it are resized as regular images
+	Document *DocumentOptions `json:"document_options"`
+	// SVG applies to svg originals
+	SVG *SVGOptions `json:"svg_options"`
+	// Transform is applied once to the original, before the size chain
+	Transform *TransformOptions `json:"transform"`
+	// Color manages the color profile of all sizes
+	Color *ColorOptions `json:"color_options"`
+	// Metadata decides which tags of the original sizes keep
+	Metadata *MetadataOptions `json:"metadata"`
+	// Placeholders lists blurhash, thumbhash and lqip to return in the response
+	Placeholders []string `json:"placeholders"`
+	// Palette asks for the dominant color and palette of the original
+	Palette *PaletteOptions `json:"palette"`
+	// Hashes lists perceptual hashes (ahash, dhash, phash) of the original to return
+	Hashes []string `json:"hashes"`
+	// KeyTemplate replaces {size_name}.{format} keys under PathToSave and must
+	// contain {size} or {hash}, keys with {hash} are immutable, uploaded only
+	// when missing and never deleted when the request fails
+	KeyTemplate string `json:"key_template"`
+	// Reprocess skips sizes already stored: if_missing keeps any stored
+	// output, if_stale regenerates outputs of a changed original or size spec,
+	// outputs stored without dimensions are regenerated by both
+	Reprocess string `json:"reprocess"`
+	// Partial keeps sizes which succeeded when others fail and reports each size's status,
+	// the request still fails when no size succeeds
+	Partial bool `json:"partial"`
+	// Atomic uploads all sizes into a staging prefix and copies them into
+	// place only when every size succeeded, a failed copy leaves the sizes
+	// copied before it in place and the error names them
+	Atomic bool `json:"atomic"`
+}
+
+type ColorOptions struct {
+	// Convert transforms colors from the embedded profile into the output
+	// profile of the server (sRGB by default), CMYK originals included
+	Convert bool `json:"convert"`
+	// DropProfile leaves converted sizes untagged, browsers assume sRGB for them
+	DropProfile bool `json:"drop_profile"`
+}
+
+type PaletteOptions struct {
+	// Colors is the palette size, 5 by default
+	Colors uint `json:"colors"`
+}
+
+type DocumentOptions struct {
+	// Page is 1-based, the first page is rendered by default
+	Page uint `json:"page"`
+	// LastPage turns Page..LastPage into a contact sheet
+	LastPage uint `json:"last_page"`
+	// Density is the rasterization DPI
+	Density uint `json:"density"`
+	// Columns of the contact sheet, square-ish grid by default
+	Columns uint `json:"columns"`
+}
+
+type TransformOptions struct {
+	// Rotate is clockwise degrees, angles other than right ones fill the corners with Background
+	Rotate     float64 `json:"rotate"`
+	Background string  `json:"background"`
+	// Flip mirrors vertically, Flop horizontally
+	Flip bool `json:"flip"`
+	Flop bool `json:"flop"`
+	// Trim removes uniform borders, colors within TrimFuzz percent of the border count as border
+	Trim     bool    `json:"trim"`
+	TrimFuzz float64 `json:"trim_fuzz"`
+}
+
+type SVGOptions struct {
+	// Density is the rasterization DPI
+	Density uint `json:"density"`
+	// Width and Height bound the rasterized image, zero keeps the size given by density
+	Width  uint `json:"width"`
+	Height uint `json:"height"`
 }
 
 func (req *Request) Validate() error {
@@ -40,6 +128,88 @@ func (req *Request) Validate() error {
 		return fmt.Errorf("AWS region is required field")
 	}
 
+	if req.Document != nil {
+		if req.Document.LastPage != 0 && req.Document.LastPage < req.Document.Page {
+			return fmt.Errorf("document_options.last_page must not be less than page")
+		}
+
+		if req.Document.Density > MaxDocumentDensity {
+			return fmt.Errorf("document_options.density must not exceed %d", MaxDocumentDensity)
+		}
+
+		if req.Document.Columns > MaxContactSheetColumns {
+			return fmt.Errorf("document_options.columns must not exceed %d", MaxContactSheetColumns)
+		}
+	}
+
+	if req.SVG != nil {
+		if req.SVG.Density > MaxSVGDensity {
+			return fmt.Errorf("svg_options.density must not exceed %d", MaxSVGDensity)
+		}
+
+		if req.SVG.Width > MaxSVGSide || req.SVG.Height > MaxSVGSide {
+			return fmt.Errorf("svg_options.width and svg_options.height must not exceed %d", MaxSVGSide)
+		}
+	}
+
+	if req.Transform != nil {
+		if req.Transform.Rotate <= -360 || req.Transform.Rotate >= 360 {
+			return fmt.Errorf("transform.rotate must be in range (-360, 360)")
+		}
+
+		if req.Transform.Background != "" && !IsValidColor(req.Transform.Background) {
+			return fmt.Errorf("transform.background %q is invalid color", req.Transform.Background)
+		}
+
+		if req.Transform.TrimFuzz < 0 || req.Transform.TrimFuzz > 100 {
+			return fmt.Errorf("transform.trim_fuzz must be in range [0, 100]")
+		}
+	}
+
+	if req.Color != nil && req.Color.DropProfile && !req.Color.Convert {
+		return fmt.Errorf("color_options.drop_profile requires color_options.convert")
+	}
+
+	for i, placeholder := range req.Placeholders {
+		if placeholder != PlaceholderBlurHash && placeholder != PlaceholderThumbHash && placeholder != PlaceholderLQIP {
+			return fmt.Errorf("placeholders[%d] must be one of: %s, %s, %s", i, PlaceholderBlurHash, PlaceholderThumbHash, PlaceholderLQIP)
+		}
+	}
+
+	if req.Palette != nil && req.Palette.Colors > MaxPaletteColors {
+		return fmt.Errorf("palette.colors must not exceed %d", MaxPaletteColors)
+	}
+
+	if err := ValidateHashes(req.Hashes); err != nil {
+		return err
+	}
+
+	if req.KeyTemplate != "" {
+		if err := ValidateKeyTemplate(req.KeyTemplate); err != nil {
+			return fmt.Errorf("key_template: %w", err)
+		}
+	}
+
+	if req.Reprocess != "" {
+		if req.Reprocess != ReprocessIfMissing && req.Reprocess != ReprocessIfStale {
+			return fmt.Errorf("reprocess must be one of: %s, %s", ReprocessIfMissing, ReprocessIfStale)
+		}
+		// stored outputs are looked up before anything is generated
+		if strings.Contains(req.KeyTemplate, KeyHash) || strings.Contains(req.KeyTemplate, KeyWidth) {
+			return fmt.Errorf("reprocess requires key_template without %s and %s", KeyHash, KeyWidth)
+		}
+	}
+
+	if req.Atomic && req.Partial {
+		return fmt.Errorf("atomic and partial are mutually exclusive")
+	}
+
+	if req.Metadata != nil {
+		if err := req.Metadata.Validate(); err != nil {
+			return fmt.Errorf("metadata: %w", err)
+		}
+	}
+
 	for i, size := range req.Sizes {
 		if size.SizeName == "" {
 			return fmt.Errorf("sizes[%d].size_name is required field", i)
@@ -49,8 +219,57 @@ func (req *Request) Validate() error {
 			return fmt.Errorf("sizes[%d].resize_options is required field", i)
 		}
 
-		if size.WaterMarkOptions != nil && size.WaterMarkOptions.WatermarkImageURL == "" {
-			return fmt.Errorf("sizes[%d].water_mark_options.water_mark_image_url is required field", i)
+		if size.ResizeOptions.TargetSSIM < 0 || size.ResizeOptions.TargetSSIM >= 1 {
+			return fmt.Errorf("sizes[%d].resize_options.target_ssim must be in range (0, 1)", i)
+		}
+
+		if size.Animation != "" && size.Animation != AnimationPoster && size.Animation != AnimationPreserve {
+			return fmt.Errorf("sizes[%d].animation must be one of: %s, %s", i, AnimationPoster, AnimationPreserve)
+		}
+
+		if len(size.Adjustments) > MaxAdjustments {
+			return fmt.Errorf("sizes[%d].adjustments must not contain more than %d operations", i, MaxAdjustments)
+		}
+
+		for j, adjustment := range size.Adjustments {
+			if err := adjustment.Validate(); err != nil {
+				return fmt.Errorf("sizes[%d].adjustments[%d]: %w", i, j, err)
+			}
+		}
+
+		if size.Mask != nil {
+			switch size.Mask.Type {
+			case MaskCircle, MaskRoundedRect:
+			case MaskImage:
+				if size.Mask.ImageURL == "" {
+					return fmt.Errorf("sizes[%d].mask.image_url is required field for %s mask", i, MaskImage)
+				}
+				if !isValidAssetURL(size.Mask.ImageURL) {
+					return fmt.Errorf("sizes[%d].mask.image_url must be http(s) url or s3://bucket/key", i)
+				}
+			default:
+				return fmt.Errorf("sizes[%d].mask.type must be one of: %s, %s, %s", i, MaskCircle, MaskRoundedRect, MaskImage)
+			}
+
+			if size.Mask.Background != "" && !IsValidColor(size.Mask.Background) {
+				return fmt.Errorf("sizes[%d].mask.background %q is invalid color", i, size.Mask.Background)
+			}
+		}
+
+		if size.WaterMarkOptions != nil {
+			if err := size.WaterMarkOptions.Validate(); err != nil {
+				return fmt.Errorf("sizes[%d].water_mark_options: %w", i, err)
+			}
+		}
+
+		for j, watermark := range size.WaterMarks {
+			if err := watermark.Validate(); err != nil {
+				return fmt.Errorf("sizes[%d].water_marks[%d]: %w", i, j, err)
+			}
+		}
+
+		if len(size.WaterMarkLayers()) > MaxWatermarkLayers {
+			return fmt.Errorf("sizes[%d] must not have more than %d watermarks", i, MaxWatermarkLayers)
 		}
 	}
 
@@ -2,6 +2,42 @@ package pkg
 
 type Response struct {
 	Sizes map[string]ResultSize `json:"sizes"`
+	// Pages is the total page count of a document original
+	Pages int `json:"pages,omitempty"`
+	// Placeholders are computed once from the prepared original on request
+	Placeholders *Placeholders `json:"placeholders,omitempty"`
+	// DominantColor and Palette are computed from the prepared original on request
+	DominantColor string         `json:"dominant_color,omitempty"`
+	Palette       []PaletteColor `json:"palette,omitempty"`
+	// Hashes are perceptual hashes of the original before transforms, hex
+	// encoded and equal to the ones of the hash endpoint
+	Hashes map[string]string `json:"hashes,omitempty"`
+}
+
+type PaletteColor struct {
+	// Color is #RRGGBB
+	Color string `json:"color"`
+	// Weight is the share of pixels closest to the color, weights sum up to 1
+	Weight float64 `json:"weight"`
+}
+
+// HasFailedSizes tells whether a partial request failed some of its sizes
+func (r *Response) HasFailedSizes() bool {
+	for _, size := range r.Sizes {
+		if size.Status == SizeStatusFailed {
+			return true
+		}
+	}
+
+	return false
+}
+
+type Placeholders struct {
+	BlurHash string `json:"blurhash,omitempty"`
+	// ThumbHash is base64 encoded
+	ThumbHash string `json:"thumbhash,omitempty"`
+	// LQIP is a data URI of a tiny jpeg
+	LQIP string `json:"lqip,omitempty"`
 }
 
 type ErrorResponse struct {
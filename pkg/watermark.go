@@ -0,0 +1,194 @@
+package pkg
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const MaxWatermarkTextLength = 100
+const MaxWatermarkStrokeWidth = 20
+const MaxWatermarkTileSpacing = 2000
+const MaxWatermarkLayers = 5
+
+var gravities = map[string]bool{
+	"northwest": true,
+	"north":     true,
+	"northeast": true,
+	"west":      true,
+	"center":    true,
+	"east":      true,
+	"southwest": true,
+	"south":     true,
+	"southeast": true,
+}
+
+// ImageMagick compose operators allowed as blend modes
+var blendModes = map[string]bool{
+	"over":       true,
+	"multiply":   true,
+	"screen":     true,
+	"overlay":    true,
+	"softlight":  true,
+	"hardlight":  true,
+	"darken":     true,
+	"lighten":    true,
+	"difference": true,
+}
+
+var fontNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+\.(ttf|otf)$`)
+
+type WaterMarkOptions struct {
+	WatermarkImageURL string `json:"water_mark_image_url"`
+	// Width and Height bound the watermark image in pixels
+	Width  uint `json:"width"`
+	Height uint `json:"height"`
+	// WidthRatio sizes the watermark image as a fraction of the target width instead
+	WidthRatio float64 `json:"width_ratio"`
+	// X and Y offset the watermark from the gravity edge in pixels,
+	// XPercent and YPercent add a share of the target width and height
+	X        int     `json:"x"`
+	Y        int     `json:"y"`
+	XPercent float64 `json:"x_percent"`
+	YPercent float64 `json:"y_percent"`
+	// Text renders a text watermark instead of the image
+	Text *TextWatermarkOptions `json:"text"`
+	// Gravity is northwest by default
+	Gravity string `json:"gravity"`
+	// Opacity from 0 to 1, the watermark is fully opaque by default
+	Opacity float64 `json:"opacity"`
+	// Rotation in degrees clockwise, applied to every tile when tiled
+	Rotation float64 `json:"rotation"`
+	// BlendMode is an ImageMagick compose operator, "over" by default
+	BlendMode string `json:"blend_mode"`
+	// Tile repeats the watermark over the whole image, TileSpacing pixels apart
+	Tile        bool `json:"tile"`
+	TileSpacing uint `json:"tile_spacing"`
+}
+
+type TextWatermarkOptions struct {
+	Text string `json:"text"`
+	// Font is a file name from the configured font directory
+	Font string `json:"font"`
+	// SizeRatio is the font size as a fraction of the image width
+	SizeRatio   float64 `json:"size_ratio"`
+	Color       string  `json:"color"`
+	StrokeColor string  `json:"stroke_color"`
+	StrokeWidth float64 `json:"stroke_width"`
+	Shadow      bool    `json:"shadow"`
+}
+
+func (w *WaterMarkOptions) Validate() error {
+	if w.Text == nil && w.WatermarkImageURL == "" {
+		return fmt.Errorf("water_mark_image_url or text is required field")
+	}
+
+	if w.Text != nil && w.WatermarkImageURL != "" {
+		return fmt.Errorf("only one of water_mark_image_url and text is allowed")
+	}
+
+	if w.WatermarkImageURL != "" && !isValidAssetURL(w.WatermarkImageURL) {
+		return fmt.Errorf("water_mark_image_url must be http(s) url or s3://bucket/key")
+	}
+
+	if w.Gravity != "" && !gravities[w.Gravity] {
+		return fmt.Errorf("gravity %q is unknown", w.Gravity)
+	}
+
+	if err := checkRange("opacity", w.Opacity, 0, 1); err != nil {
+		return err
+	}
+
+	if err := checkRange("rotation", w.Rotation, -360, 360); err != nil {
+		return err
+	}
+
+	if err := checkRange("width_ratio", w.WidthRatio, 0, 1); err != nil {
+		return err
+	}
+
+	if err := checkRange("x_percent", w.XPercent, -100, 100); err != nil {
+		return err
+	}
+
+	if err := checkRange("y_percent", w.YPercent, -100, 100); err != nil {
+		return err
+	}
+
+	if w.BlendMode != "" && !blendModes[w.BlendMode] {
+		return fmt.Errorf("blend_mode %q is unknown", w.BlendMode)
+	}
+
+	if w.TileSpacing > MaxWatermarkTileSpacing {
+		return fmt.Errorf("tile_spacing must not exceed %d", MaxWatermarkTileSpacing)
+	}
+
+	if w.Text != nil {
+		if err := w.Text.Validate(); err != nil {
+			return fmt.Errorf("text: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (t *TextWatermarkOptions) Validate() error {
+	if strings.TrimSpace(t.Text) == "" {
+		return fmt.Errorf("text is required field")
+	}
+
+	if utf8.RuneCountInString(t.Text) > MaxWatermarkTextLength {
+		return fmt.Errorf("text must not be longer than %d characters", MaxWatermarkTextLength)
+	}
+
+	for _, r := range t.Text {
+		if !isAllowedTextRune(r) {
+			return fmt.Errorf("text contains not allowed character %q", r)
+		}
+	}
+
+	if t.Font != "" && !fontNamePattern.MatchString(t.Font) {
+		return fmt.Errorf("font %q must be a ttf or otf file name", t.Font)
+	}
+
+	if err := checkRange("size_ratio", t.SizeRatio, 0, 1); err != nil {
+		return err
+	}
+
+	if t.Color != "" && !IsValidColor(t.Color) {
+		return fmt.Errorf("color %q is invalid", t.Color)
+	}
+
+	if t.StrokeColor != "" && !IsValidColor(t.StrokeColor) {
+		return fmt.Errorf("stroke_color %q is invalid", t.StrokeColor)
+	}
+
+	return checkRange("stroke_width", t.StrokeWidth, 0, MaxWatermarkStrokeWidth)
+}
+
+func isValidAssetURL(rawUrl string) bool {
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return true
+	case "s3":
+		return strings.TrimPrefix(u.Path, "/") != ""
+	}
+
+	return false
+}
+
+// text is a single line of printable characters, escapes are handled by the renderer
+func isAllowedTextRune(r rune) bool {
+	if r == ' ' {
+		return true
+	}
+
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsMark(r)
+}